@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dto "github.com/prometheus/client_model/go"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the contents of the file given with --config
+type Config struct {
+	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs"`
+
+	// GroupRules are tried before DefaultGroupRules, unless
+	// DisableDefaultGroupRules is set
+	GroupRules               []*GroupRule `yaml:"group_rules"`
+	DisableDefaultGroupRules bool         `yaml:"disable_default_group_rules"`
+
+	// ValueRules are tried before the built-in rules for the version of
+	// kube-state-metrics, unless DisableDefaultValueRules is set
+	ValueRules               []*ValueRule `yaml:"value_rules"`
+	DisableDefaultValueRules bool         `yaml:"disable_default_value_rules"`
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", filename, err)
+	}
+
+	jobs := map[string]bool{}
+	for _, sc := range config.ScrapeConfigs {
+		if sc.JobName == "" {
+			return nil, errors.New("job_name is required for every scrape config")
+		}
+		if jobs[sc.JobName] {
+			return nil, fmt.Errorf("duplicate job_name %q", sc.JobName)
+		}
+		jobs[sc.JobName] = true
+		if err := sc.Init(); err != nil {
+			return nil, fmt.Errorf("Error in job %q: %v", sc.JobName, err)
+		}
+	}
+	for _, r := range config.GroupRules {
+		if err := r.Compile(); err != nil {
+			return nil, fmt.Errorf("Error in group rule %q: %v", r.Match, err)
+		}
+	}
+	for _, r := range config.ValueRules {
+		if err := r.Compile(); err != nil {
+			return nil, fmt.Errorf("Error in value rule %q: %v", r.Match, err)
+		}
+	}
+	return config, nil
+}
+
+// ScrapeConfig describes a set of targets and how to authenticate to them
+type ScrapeConfig struct {
+	JobName string            `yaml:"job_name"`
+	URLs    []string          `yaml:"urls"`
+	FileSD  []string          `yaml:"file_sd"`
+	HTTPSD  []string          `yaml:"http_sd"`
+	Labels  map[string]string `yaml:"labels"`
+
+	// Match selects the series to scrape from the /federate endpoint of a
+	// Prometheus server, and handles the federation format. See
+	// FederatedFamilies.
+	Match []string `yaml:"match"`
+
+	// Queries are run against the Prometheus HTTP API at each URL instead
+	// of scraping it. See Query.
+	Queries []*Query `yaml:"queries"`
+
+	// ScrapeTimeout bounds each attempt at scraping a target. Failed scrapes
+	// are retried up to Retries times, waiting RetryBackoff, then twice as
+	// long for each following attempt.
+	ScrapeTimeout time.Duration `yaml:"scrape_timeout"`
+	Retries       int           `yaml:"retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"`
+
+	BearerToken     string     `yaml:"bearer_token"`
+	BearerTokenFile string     `yaml:"bearer_token_file"`
+	BasicAuth       *BasicAuth `yaml:"basic_auth"`
+	TLSConfig       TLSConfig  `yaml:"tls_config"`
+
+	client *http.Client
+	// Used for the job's targets instead of the scrape pool's options
+	converterOptions *ConverterOptions
+}
+
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Init validates the config and sets up its HTTP client. It must be called
+// before the config is used to scrape.
+func (sc *ScrapeConfig) Init() error {
+	if sc.BearerToken != "" && sc.BearerTokenFile != "" {
+		return errors.New("at most one of bearer_token and bearer_token_file may be set")
+	}
+	if sc.BasicAuth != nil && (sc.BearerToken != "" || sc.BearerTokenFile != "") {
+		return errors.New("at most one of basic_auth and bearer_token may be set")
+	}
+	if sc.ScrapeTimeout < 0 || sc.Retries < 0 || sc.RetryBackoff < 0 {
+		return errors.New("scrape_timeout, retries and retry_backoff can't be negative")
+	}
+	if len(sc.Match) > 0 && len(sc.Queries) > 0 {
+		return errors.New("at most one of match and queries may be set")
+	}
+	for _, q := range sc.Queries {
+		if q.Query == "" {
+			return errors.New("queries need a query")
+		}
+	}
+
+	tlsConfig, err := sc.TLSConfig.build()
+	if err != nil {
+		return err
+	}
+	sc.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return nil
+}
+
+func (tc *TLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+
+	if tc.CAFile != "" {
+		ca, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("unable to parse CA certificates in %s", tc.CAFile)
+		}
+	}
+
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+	if tc.CertFile != "" {
+		// Fail early on a bad key pair, but load it on each handshake so
+		// rotated certificates are picked up
+		if _, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+			return &cert, err
+		}
+	}
+	return config, nil
+}
+
+// authorize adds credentials to req. Token and password files are re-read
+// on every request, since they may be rotated, e.g. for service account
+// tokens.
+func (sc *ScrapeConfig) authorize(req *http.Request) error {
+	switch {
+	case sc.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+sc.BearerToken)
+	case sc.BearerTokenFile != "":
+		token, err := ioutil.ReadFile(sc.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("Error reading bearer token file: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	case sc.BasicAuth != nil:
+		password := sc.BasicAuth.Password
+		if sc.BasicAuth.PasswordFile != "" {
+			data, err := ioutil.ReadFile(sc.BasicAuth.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("Error reading password file: %v", err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		req.SetBasicAuth(sc.BasicAuth.Username, password)
+	}
+	return nil
+}
+
+// retryableError is returned for responses worth retrying, i.e. 5xx and 429
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (re *retryableError) Error() string {
+	return re.err.Error()
+}
+
+// Scrape fetches and parses the metrics at url using the config's
+// credentials and TLS settings, retrying on 5xx and 429 responses. It gives
+// up when ctx is done.
+func (sc *ScrapeConfig) Scrape(ctx context.Context, url string) ([]*dto.MetricFamily, error) {
+	backoff := sc.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		mfs, err := sc.scrape(ctx, url)
+		re, ok := err.(*retryableError)
+		if !ok || attempt >= sc.Retries {
+			return mfs, err
+		}
+
+		wait := backoff
+		if re.retryAfter > wait {
+			wait = re.retryAfter
+		}
+		backoff *= 2
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"target": url,
+			"wait":   wait,
+		}).Warn("Retrying scrape")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+func (sc *ScrapeConfig) scrape(ctx context.Context, url string) ([]*dto.MetricFamily, error) {
+	timeout := sc.ScrapeTimeout
+	if deadline, ok := ctx.Deadline(); ok && (timeout == 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline) / time.Millisecond * time.Millisecond
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if len(sc.Queries) > 0 {
+		return sc.query(ctx, url, timeout)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(sc.Match) > 0 {
+		query := req.URL.Query()
+		for _, m := range sc.Match {
+			query.Add("match[]", m)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	req.Header.Add("Accept", acceptHeader)
+	resp, err := sc.do(ctx, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	mfs, err := ParseResponse(resp.Header.Get("Content-Type"), resp.Body)
+	if err != nil || len(sc.Match) == 0 {
+		return mfs, err
+	}
+	return FederatedFamilies(mfs), nil
+}
+
+// do sends req with the config's credentials, and returns a retryableError
+// for responses worth retrying. Other responses are left to the caller.
+func (sc *ScrapeConfig) do(ctx context.Context, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	if timeout > 0 {
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	}
+	if err := sc.authorize(req); err != nil {
+		return nil, err
+	}
+
+	client := sc.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		resp.Body.Close()
+		re := &retryableError{err: fmt.Errorf("server returned %s", resp.Status)}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			re.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, re
+	}
+	return resp, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMetrics = `# TYPE kube_node_spec_unschedulable gauge
+kube_node_spec_unschedulable{node="node-1"} 0
+`
+
+func TestScrapeConfigBearerTokenFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prom2hny")
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(testMetrics))
+	}))
+	defer server.Close()
+
+	sc := &ScrapeConfig{BearerTokenFile: tokenFile}
+	assert.NoError(t, sc.Init())
+
+	ioutil.WriteFile(tokenFile, []byte("first\n"), 0600)
+	mfs, err := sc.Scrape(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Len(t, mfs, 1)
+	assert.Equal(t, "Bearer first", auth)
+
+	// Rotated tokens are picked up on the next scrape
+	ioutil.WriteFile(tokenFile, []byte("second\n"), 0600)
+	sc.Scrape(context.Background(), server.URL)
+	assert.Equal(t, "Bearer second", auth)
+}
+
+func TestScrapeConfigBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "prom" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(testMetrics))
+	}))
+	defer server.Close()
+
+	sc := &ScrapeConfig{BasicAuth: &BasicAuth{Username: "prom", Password: "secret"}}
+	assert.NoError(t, sc.Init())
+	_, err := sc.Scrape(context.Background(), server.URL)
+	assert.NoError(t, err)
+
+	sc = &ScrapeConfig{BasicAuth: &BasicAuth{Username: "prom", Password: "wrong"}}
+	assert.NoError(t, sc.Init())
+	_, err = sc.Scrape(context.Background(), server.URL)
+	assert.Error(t, err)
+}
+
+func TestScrapeConfigTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testMetrics))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "prom2hny")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.TLS.Certificates[0].Certificate[0],
+	}), 0644)
+
+	// The test server's certificate isn't trusted by default
+	sc := &ScrapeConfig{}
+	assert.NoError(t, sc.Init())
+	_, err := sc.Scrape(context.Background(), server.URL)
+	assert.Error(t, err)
+
+	sc = &ScrapeConfig{TLSConfig: TLSConfig{CAFile: caFile}}
+	assert.NoError(t, sc.Init())
+	_, err = sc.Scrape(context.Background(), server.URL)
+	assert.NoError(t, err)
+
+	sc = &ScrapeConfig{TLSConfig: TLSConfig{InsecureSkipVerify: true}}
+	assert.NoError(t, sc.Init())
+	_, err = sc.Scrape(context.Background(), server.URL)
+	assert.NoError(t, err)
+}
+
+// writeClientCert writes a self-signed client certificate and its key to
+// certFile and keyFile, and returns the certificate
+func writeClientCert(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "prom2hny"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestScrapeConfigClientCert(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prom2hny")
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(writeClientCert(t, certFile, keyFile))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testMetrics))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	sc := &ScrapeConfig{TLSConfig: TLSConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}}
+	assert.NoError(t, sc.Init())
+	mfs, err := sc.Scrape(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Len(t, mfs, 1)
+
+	// Without a certificate the handshake fails
+	noCert := &ScrapeConfig{TLSConfig: TLSConfig{InsecureSkipVerify: true}}
+	assert.NoError(t, noCert.Init())
+	_, err = noCert.Scrape(context.Background(), server.URL)
+	assert.Error(t, err)
+
+	// The key pair is read again on each handshake, so a rotated one the
+	// server doesn't trust is used straight away
+	writeClientCert(t, certFile, keyFile)
+	sc.client.Transport.(*http.Transport).CloseIdleConnections()
+	_, err = sc.Scrape(context.Background(), server.URL)
+	assert.Error(t, err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prom2hny")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+
+	ioutil.WriteFile(filename, []byte(`
+scrape_configs:
+  - job_name: kubelet
+    urls: ["https://10.0.0.1:10250/metrics/cadvisor"]
+    bearer_token_file: /var/run/secrets/kubernetes.io/serviceaccount/token
+    tls_config:
+      insecure_skip_verify: true
+  - job_name: ksm
+    urls: ["https://kube-state-metrics:8443/metrics"]
+    basic_auth:
+      username: prom
+      password: secret
+`), 0644)
+	config, err := LoadConfig(filename)
+	assert.NoError(t, err)
+	assert.Len(t, config.ScrapeConfigs, 2)
+	assert.True(t, config.ScrapeConfigs[0].TLSConfig.InsecureSkipVerify)
+	assert.Equal(t, "prom", config.ScrapeConfigs[1].BasicAuth.Username)
+
+	for _, bad := range []string{
+		"scrape_configs: [{urls: [http://a]}]",
+		"scrape_configs: [{job_name: a}, {job_name: a}]",
+		"scrape_configs: [{job_name: a, bearer_token: x, bearer_token_file: y}]",
+		"scrape_configs: [{job_name: a, tls_config: {cert_file: a.crt}}]",
+		"scrape_configs: [{job_name: a, unknown_field: true}]",
+	} {
+		ioutil.WriteFile(filename, []byte(bad), 0644)
+		_, err := LoadConfig(filename)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestScrapeConfigRetries(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "2.5", r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"))
+		attempts++
+		switch attempts {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte(testMetrics))
+		}
+	}))
+	defer server.Close()
+
+	sc := &ScrapeConfig{ScrapeTimeout: 2500 * time.Millisecond, Retries: 1, RetryBackoff: time.Millisecond}
+	assert.NoError(t, sc.Init())
+	_, err := sc.Scrape(context.Background(), server.URL)
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	sc.Retries = 2
+	_, err = sc.Scrape(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestScrapeConfigTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	sc := &ScrapeConfig{ScrapeTimeout: 50 * time.Millisecond}
+	assert.NoError(t, sc.Init())
+	start := time.Now()
+	_, err := sc.Scrape(context.Background(), server.URL)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Cancelling the context stops the scrape too
+	sc = &ScrapeConfig{}
+	assert.NoError(t, sc.Init())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = sc.Scrape(ctx, server.URL)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterState is what we remember about a counter series between scrapes
+type counterState struct {
+	value   float64
+	created float64
+	time    time.Time
+}
+
+// seriesKey identifies a series by its metric name and labels
+func seriesKey(name string, m *dto.Metric) string {
+	return name + "\xff" + labelsKey(m)
+}
+
+func labelsKey(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, lp := range m.Label {
+		pairs = append(pairs, lp.GetName()+"\xfe"+lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+func createdName(counterName string) string {
+	return strings.TrimSuffix(counterName, "_total") + "_created"
+}
+
+// getCreatedTimes collects the <name>_created series that go with
+// cumulative metrics in mfs, by family name and then labels
+func getCreatedTimes(mfs []*dto.MetricFamily) map[string]map[string]float64 {
+	counters := map[string]bool{}
+	for _, mf := range mfs {
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER, dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+			counters[createdName(mf.GetName())] = true
+		}
+	}
+
+	result := map[string]map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_GAUGE || !counters[mf.GetName()] {
+			continue
+		}
+		created := make(map[string]float64, len(mf.Metric))
+		for _, m := range mf.Metric {
+			created[labelsKey(m)] = m.GetGauge().GetValue()
+		}
+		result[mf.GetName()] = created
+	}
+	return result
+}
+
+func sampleTime(m *dto.Metric, now time.Time) time.Time {
+	if m.TimestampMs != nil {
+		return time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+	}
+	return now
+}
+
+// getCounterDatapoints returns <name>.delta, the increase since the last
+// scrape, and <name>.rate, the increase per second. Nothing is returned the
+// first time a series is seen. A counter that went down, or whose _created
+// time changed, was reset, so all of its current value is new.
+func (c *Converter) getCounterDatapoints(mf *dto.MetricFamily, m *dto.Metric, createdTimes map[string]map[string]float64, now time.Time) []*DataPoint {
+	name := mf.GetName()
+	labels := makeLabels(m)
+	state := &counterState{
+		value: m.GetCounter().GetValue(),
+		time:  sampleTime(m, now),
+	}
+	created, hasCreated := createdTimes[createdName(name)][labelsKey(m)]
+	state.created = created
+
+	key := seriesKey(name, m)
+	prev, ok := c.prev[key].(*counterState)
+	c.next[key] = state
+
+	var dps []*DataPoint
+	if c.options.EmitCumulative {
+		dps = append(dps, &DataPoint{Name: name, Value: state.value, Labels: labels})
+	}
+	if !ok || !state.time.After(prev.time) {
+		return dps
+	}
+
+	delta := state.value - prev.value
+	if delta < 0 || (hasCreated && created != prev.created) {
+		delta = state.value
+	}
+	rate := delta / state.time.Sub(prev.time).Seconds()
+
+	return append(dps,
+		&DataPoint{Name: name + ".delta", Value: delta, Labels: labels},
+		&DataPoint{Name: name + ".rate", Value: rate, Labels: labels},
+	)
+}
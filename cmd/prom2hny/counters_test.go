@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// datapointValues returns the values of every datapoint in metricGroups
+func datapointValues(metricGroups []*MetricGroup) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, mg := range metricGroups {
+		for _, dp := range mg.DataPoints {
+			result[dp.Name] = dp.Value
+		}
+	}
+	return result
+}
+
+func convertText(c *Converter, text string, now time.Time) []*MetricGroup {
+	mfs, _ := ParseResponse("text/plain", strings.NewReader(text))
+	return c.Convert(mfs, now)
+}
+
+func TestCounterDeltas(t *testing.T) {
+	const restarts = `# TYPE kube_pod_container_status_restarts_total counter
+kube_pod_container_status_restarts_total{namespace="default",pod="app-1",container="app"} %s
+`
+	c := NewConverter(ConverterOptions{})
+	start := time.Now()
+
+	// Nothing to compare the first scrape to
+	groups := convertText(c, strings.Replace(restarts, "%s", "3", 1), start)
+	assert.Empty(t, groups)
+
+	groups = convertText(c, strings.Replace(restarts, "%s", "7", 1), start.Add(10*time.Second))
+	assert.Equal(t, map[string]interface{}{
+		"kube_pod_container_status_restarts_total.delta": 4.0,
+		"kube_pod_container_status_restarts_total.rate":  0.4,
+	}, datapointValues(groups))
+	assert.Equal(t, "pod-container", groups[0].MetricGroup)
+
+	// The counter went down, so it was reset
+	groups = convertText(c, strings.Replace(restarts, "%s", "2", 1), start.Add(20*time.Second))
+	assert.Equal(t, 2.0, datapointValues(groups)["kube_pod_container_status_restarts_total.delta"])
+}
+
+func TestCounterCreatedReset(t *testing.T) {
+	const requests = `# TYPE kube_apiserver_requests counter
+kube_apiserver_requests_total{code="200"} %s
+kube_apiserver_requests_created{code="200"} %s
+# EOF
+`
+	c := NewConverter(ConverterOptions{EmitCumulative: true})
+	start := time.Now()
+	parse := func(value, created string, now time.Time) map[string]interface{} {
+		text := strings.Replace(strings.Replace(requests, "%s", value, 1), "%s", created, 1)
+		mfs, err := ParseOpenMetrics(strings.NewReader(text))
+		assert.NoError(t, err)
+		return datapointValues(c.Convert(mfs, now))
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"kube_apiserver_requests_total": 10.0,
+	}, parse("10", "1000", start))
+	assert.Equal(t, 5.0, parse("15", "1000", start.Add(time.Second))["kube_apiserver_requests_total.delta"])
+
+	// Restarted and went past the previous value within one interval
+	values := parse("20", "2000", start.Add(2*time.Second))
+	assert.Equal(t, 20.0, values["kube_apiserver_requests_total.delta"])
+	assert.NotContains(t, values, "kube_apiserver_requests_created")
+}
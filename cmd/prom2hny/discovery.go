@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Discoverer finds targets to scrape. Discover is called periodically and
+// should return the complete current set of targets.
+type Discoverer interface {
+	Discover() ([]*Target, error)
+}
+
+// discoveryManager keeps the scrape pool in sync with the union of the
+// targets found by every discovery source
+type discoveryManager struct {
+	pool *scrapePool
+
+	mtx     sync.Mutex
+	targets map[string][]*Target
+}
+
+func newDiscoveryManager(pool *scrapePool) *discoveryManager {
+	return &discoveryManager{
+		pool:    pool,
+		targets: make(map[string][]*Target),
+	}
+}
+
+// SetTargets replaces the targets previously provided by source
+func (dm *discoveryManager) SetTargets(source string, targets []*Target) {
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+
+	dm.targets[source] = targets
+
+	sources := make([]string, 0, len(dm.targets))
+	for s := range dm.targets {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+
+	var all []*Target
+	for _, s := range sources {
+		all = append(all, dm.targets[s]...)
+	}
+	dm.pool.Sync(all)
+}
+
+// Run polls d every refresh interval until ctx is cancelled. If discovery
+// fails, the targets from the last successful run are kept.
+func (dm *discoveryManager) Run(ctx context.Context, source string, d Discoverer, refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		targets, err := d.Discover()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"source": source,
+			}).Error("Error discovering targets")
+		} else {
+			dm.SetTargets(source, targets)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// withScrapeConfig makes every target found by d use config
+func withScrapeConfig(d Discoverer, config *ScrapeConfig) Discoverer {
+	return &scrapeConfigDiscoverer{d: d, config: config}
+}
+
+type scrapeConfigDiscoverer struct {
+	d      Discoverer
+	config *ScrapeConfig
+}
+
+func (sd *scrapeConfigDiscoverer) Discover() ([]*Target, error) {
+	targets, err := sd.d.Discover()
+	if err != nil {
+		return nil, err
+	}
+	// Copy rather than modify, discoverers may hand out the same targets
+	// on every call
+	result := make([]*Target, 0, len(targets))
+	for _, t := range targets {
+		result = append(result, &Target{URL: t.URL, Labels: t.Labels, Config: sd.config})
+	}
+	return result, nil
+}
+
+// targetGroup is a list of targets sharing labels, in the format used by
+// Prometheus' file_sd_configs and http_sd_configs
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// toTargets converts host:port targets into scrape URLs. The __scheme__,
+// __metrics_path__ and __param_<name> labels control the URL like they do
+// in Prometheus, other labels starting with __ are dropped.
+func (tg *targetGroup) toTargets() []*Target {
+	scheme, path := "http", "/metrics"
+	params := url.Values{}
+	labels := map[string]string{}
+	for name, value := range tg.Labels {
+		switch {
+		case name == "__scheme__":
+			scheme = value
+		case name == "__metrics_path__":
+			path = value
+		case strings.HasPrefix(name, "__param_"):
+			params.Set(strings.TrimPrefix(name, "__param_"), value)
+		case strings.HasPrefix(name, "__"):
+		default:
+			labels[name] = value
+		}
+	}
+
+	targets := make([]*Target, 0, len(tg.Targets))
+	for _, address := range tg.Targets {
+		u := &url.URL{
+			Scheme:   scheme,
+			Host:     address,
+			Path:     path,
+			RawQuery: params.Encode(),
+		}
+		targets = append(targets, &Target{URL: u.String(), Labels: labels})
+	}
+	return targets
+}
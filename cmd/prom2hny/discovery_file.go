@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FileDiscoverer reads targets from JSON or YAML files in the Prometheus
+// file_sd_configs format. Files are only re-read when they change, and a
+// file that fails to parse keeps its previous targets, so a half-written
+// file doesn't drop targets.
+type FileDiscoverer struct {
+	Patterns []string
+
+	files map[string]*sdFile
+}
+
+type sdFile struct {
+	modTime time.Time
+	size    int64
+	targets []*Target
+}
+
+func NewFileDiscoverer(patterns []string) *FileDiscoverer {
+	return &FileDiscoverer{
+		Patterns: patterns,
+		files:    make(map[string]*sdFile),
+	}
+}
+
+func (fd *FileDiscoverer) Discover() ([]*Target, error) {
+	var paths []string
+	for _, pattern := range fd.Patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	files := make(map[string]*sdFile, len(paths))
+	var targets []*Target
+	for _, path := range paths {
+		if _, ok := files[path]; ok {
+			continue
+		}
+		f, err := fd.readFile(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  path,
+			}).Error("Error reading targets file")
+			if f = fd.files[path]; f == nil {
+				continue
+			}
+		}
+		files[path] = f
+		targets = append(targets, f.targets...)
+	}
+	fd.files = files
+
+	return targets, nil
+}
+
+func (fd *FileDiscoverer) readFile(path string) (*sdFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := fd.files[path]; ok && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return f, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*targetGroup
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(data, &groups)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &groups)
+	default:
+		err = fmt.Errorf("unsupported file extension %q", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := &sdFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	for _, tg := range groups {
+		f.targets = append(f.targets, tg.toTargets()...)
+	}
+	logrus.WithFields(logrus.Fields{
+		"file":    path,
+		"targets": len(f.targets),
+	}).Info("Loaded targets file")
+	return f, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func targetURLs(targets []*Target) []string {
+	var urls []string
+	for _, t := range targets {
+		urls = append(urls, t.URL)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+func TestFileDiscoverer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prom2hny")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`[
+		{"targets": ["10.0.0.1:9100", "10.0.0.2:9100"], "labels": {"env": "prod"}}
+	]`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.yml"), []byte(`
+- targets: ["redis:9121"]
+  labels:
+    __scheme__: https
+    __metrics_path__: /scrape
+    __param_target: redis://localhost
+    team: cache
+`), 0644)
+
+	fd := NewFileDiscoverer([]string{filepath.Join(dir, "*")})
+	targets, err := fd.Discover()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"http://10.0.0.1:9100/metrics",
+		"http://10.0.0.2:9100/metrics",
+		"https://redis:9121/scrape?target=redis%3A%2F%2Flocalhost",
+	}, targetURLs(targets))
+	assert.Equal(t, map[string]string{"env": "prod"}, targets[0].Labels)
+	assert.Equal(t, map[string]string{"team": "cache"}, targets[2].Labels)
+
+	// A broken file keeps its previous targets
+	future := time.Now().Add(time.Minute)
+	ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`[{"targets": [`), 0644)
+	os.Chtimes(filepath.Join(dir, "a.json"), future, future)
+	targets, _ = fd.Discover()
+	assert.Len(t, targets, 3)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`[{"targets": ["10.0.0.3:9100"]}]`), 0644)
+	os.Chtimes(filepath.Join(dir, "a.json"), future.Add(time.Minute), future.Add(time.Minute))
+	os.Remove(filepath.Join(dir, "b.yml"))
+	targets, _ = fd.Discover()
+	assert.Equal(t, []string{"http://10.0.0.3:9100/metrics"}, targetURLs(targets))
+}
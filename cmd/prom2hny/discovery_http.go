@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPDiscoverer polls an endpoint that returns a JSON list of target
+// groups, in the format used by Prometheus' http_sd_configs
+type HTTPDiscoverer struct {
+	URL             string
+	RefreshInterval time.Duration
+	Client          *http.Client
+}
+
+func NewHTTPDiscoverer(url string, refresh time.Duration) *HTTPDiscoverer {
+	return &HTTPDiscoverer{
+		URL:             url,
+		RefreshInterval: refresh,
+		Client:          &http.Client{Timeout: refresh},
+	}
+}
+
+func (hd *HTTPDiscoverer) Discover() ([]*Target, error) {
+	req, err := http.NewRequest("GET", hd.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Prometheus-Refresh-Interval-Seconds", strconv.Itoa(int(hd.RefreshInterval.Seconds())))
+
+	resp, err := hd.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching targets: server returned %s", resp.Status)
+	}
+	if mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediatype != "application/json" {
+		return nil, fmt.Errorf("Error fetching targets: unexpected Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+
+	var groups []*targetGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("Error decoding targets: %v", err)
+	}
+
+	var targets []*Target
+	for _, tg := range groups {
+		targets = append(targets, tg.toTargets()...)
+	}
+	return targets, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPDiscoverer(t *testing.T) {
+	response := `[{"targets": ["10.0.0.1:9100", "10.0.0.2:9100"], "labels": {"team": "infra"}}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "60", r.Header.Get("X-Prometheus-Refresh-Interval-Seconds"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	hd := NewHTTPDiscoverer(server.URL, time.Minute)
+	targets, err := hd.Discover()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://10.0.0.1:9100/metrics", "http://10.0.0.2:9100/metrics"}, targetURLs(targets))
+	assert.Equal(t, map[string]string{"team": "infra"}, targets[0].Labels)
+
+	// Removed targets are dropped from the next refresh
+	response = `[{"targets": ["10.0.0.2:9100"]}]`
+	targets, err = hd.Discover()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://10.0.0.2:9100/metrics"}, targetURLs(targets))
+}
+
+func TestHTTPDiscovererErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	_, err := NewHTTPDiscoverer(server.URL, time.Minute).Discover()
+	assert.Error(t, err)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	scrapeAnnotation = "prometheus.io/scrape"
+	portAnnotation   = "prometheus.io/port"
+	pathAnnotation   = "prometheus.io/path"
+	schemeAnnotation = "prometheus.io/scheme"
+)
+
+// KubernetesDiscoverer finds pods and services annotated with
+// prometheus.io/scrape=true by listing them from the Kubernetes API
+type KubernetesDiscoverer struct {
+	APIServer  string
+	TokenFile  string
+	Namespaces []string
+	Client     *http.Client
+}
+
+// NewInClusterKubernetesDiscoverer talks to the API server using the pod's
+// service account. apiServer overrides the address found in the
+// environment, e.g. to go through `kubectl proxy`.
+func NewInClusterKubernetesDiscoverer(apiServer string, namespaces []string) (*KubernetesDiscoverer, error) {
+	kd := &KubernetesDiscoverer{
+		APIServer:  apiServer,
+		Namespaces: namespaces,
+		Client:     &http.Client{},
+	}
+	if kd.APIServer != "" {
+		return kd, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster and no API server was given")
+	}
+	kd.APIServer = "https://" + net.JoinHostPort(host, port)
+	kd.TokenFile = serviceAccountDir + "/token"
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("unable to parse the service account CA certificate")
+	}
+	kd.Client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return kd, nil
+}
+
+type kubeObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type kubePodList struct {
+	Items []struct {
+		Metadata kubeObjectMeta `json:"metadata"`
+		Spec     struct {
+			NodeName   string `json:"nodeName"`
+			Containers []struct {
+				Ports []struct {
+					ContainerPort int `json:"containerPort"`
+				} `json:"ports"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type kubeServiceList struct {
+	Items []struct {
+		Metadata kubeObjectMeta `json:"metadata"`
+		Spec     struct {
+			Ports []struct {
+				Port int `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+func (kd *KubernetesDiscoverer) Discover() ([]*Target, error) {
+	namespaces := kd.Namespaces
+	if len(namespaces) == 0 {
+		// An empty namespace lists across all namespaces
+		namespaces = []string{""}
+	}
+
+	var targets []*Target
+	for _, ns := range namespaces {
+		pods := &kubePodList{}
+		if err := kd.list(ns, "pods", pods); err != nil {
+			return nil, err
+		}
+		for _, pod := range pods.Items {
+			if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+				continue
+			}
+			port := 0
+			for _, c := range pod.Spec.Containers {
+				if len(c.Ports) > 0 {
+					port = c.Ports[0].ContainerPort
+					break
+				}
+			}
+			url, ok := annotatedURL(pod.Metadata.Annotations, pod.Status.PodIP, port)
+			if !ok {
+				continue
+			}
+			targets = append(targets, &Target{
+				URL: url,
+				Labels: map[string]string{
+					"kubernetes_namespace": pod.Metadata.Namespace,
+					"kubernetes_pod_name":  pod.Metadata.Name,
+					"kubernetes_node":      pod.Spec.NodeName,
+				},
+			})
+		}
+
+		services := &kubeServiceList{}
+		if err := kd.list(ns, "services", services); err != nil {
+			return nil, err
+		}
+		for _, svc := range services.Items {
+			port := 0
+			if len(svc.Spec.Ports) > 0 {
+				port = svc.Spec.Ports[0].Port
+			}
+			host := fmt.Sprintf("%s.%s.svc", svc.Metadata.Name, svc.Metadata.Namespace)
+			url, ok := annotatedURL(svc.Metadata.Annotations, host, port)
+			if !ok {
+				continue
+			}
+			targets = append(targets, &Target{
+				URL: url,
+				Labels: map[string]string{
+					"kubernetes_namespace":    svc.Metadata.Namespace,
+					"kubernetes_service_name": svc.Metadata.Name,
+				},
+			})
+		}
+	}
+	return targets, nil
+}
+
+func (kd *KubernetesDiscoverer) list(namespace, resource string, into interface{}) error {
+	path := "/api/v1/" + resource
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + namespace + "/" + resource
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(kd.APIServer, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	if kd.TokenFile != "" {
+		// Re-read on every request, the token is rotated by the kubelet
+		token, err := ioutil.ReadFile(kd.TokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := kd.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error listing %s: server returned %s", resource, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+// annotatedURL builds the scrape URL from the prometheus.io annotations.
+// The port annotation takes precedence over defaultPort.
+func annotatedURL(annotations map[string]string, host string, defaultPort int) (string, bool) {
+	if annotations[scrapeAnnotation] != "true" {
+		return "", false
+	}
+
+	port := defaultPort
+	if p, ok := annotations[portAnnotation]; ok {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			return "", false
+		}
+	}
+	if port == 0 {
+		return "", false
+	}
+
+	scheme := annotations[schemeAnnotation]
+	if scheme == "" {
+		scheme = "http"
+	}
+	path := annotations[pathAnnotation]
+	if path == "" {
+		path = "/metrics"
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), path), true
+}
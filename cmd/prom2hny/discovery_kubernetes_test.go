@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakePods = `{"items": [
+  {"metadata": {"name": "ksm-1", "namespace": "kube-system", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "8080"}},
+   "spec": {"nodeName": "node-1"}, "status": {"phase": "Running", "podIP": "10.0.0.1"}},
+  {"metadata": {"name": "app-1", "namespace": "default", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/path": "stats"}},
+   "spec": {"nodeName": "node-2", "containers": [{"ports": [{"containerPort": 9000}]}]}, "status": {"phase": "Running", "podIP": "10.0.0.2"}},
+  {"metadata": {"name": "pending", "namespace": "default", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "80"}},
+   "spec": {}, "status": {"phase": "Pending"}},
+  {"metadata": {"name": "unannotated", "namespace": "default"},
+   "spec": {"containers": [{"ports": [{"containerPort": 80}]}]}, "status": {"phase": "Running", "podIP": "10.0.0.3"}}
+]}`
+
+const fakeServices = `{"items": [
+  {"metadata": {"name": "kube-state-metrics", "namespace": "kube-system", "annotations": {"prometheus.io/scrape": "true"}},
+   "spec": {"ports": [{"port": 8080}]}},
+  {"metadata": {"name": "kubernetes", "namespace": "default"}, "spec": {"ports": [{"port": 443}]}}
+]}`
+
+func TestKubernetesDiscoverer(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/pods", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fakePods))
+	})
+	mux.HandleFunc("/api/v1/services", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fakeServices))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	kd, err := NewInClusterKubernetesDiscoverer(server.URL, nil)
+	assert.NoError(t, err)
+	targets, err := kd.Discover()
+	assert.NoError(t, err)
+
+	var urls []string
+	for _, target := range targets {
+		urls = append(urls, target.URL)
+	}
+	sort.Strings(urls)
+	assert.Equal(t, []string{
+		"http://10.0.0.1:8080/metrics",
+		"http://10.0.0.2:9000/stats",
+		"http://kube-state-metrics.kube-system.svc:8080/metrics",
+	}, urls)
+	assert.Equal(t, map[string]string{
+		"kubernetes_namespace": "kube-system",
+		"kubernetes_pod_name":  "ksm-1",
+		"kubernetes_node":      "node-1",
+	}, targets[0].Labels)
+}
+
+func TestKubernetesDiscovererNamespaces(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{"items": []}`))
+	}))
+	defer server.Close()
+
+	kd, _ := NewInClusterKubernetesDiscoverer(server.URL, []string{"monitoring"})
+	targets, err := kd.Discover()
+	assert.NoError(t, err)
+	assert.Empty(t, targets)
+	assert.Equal(t, []string{
+		"/api/v1/namespaces/monitoring/pods",
+		"/api/v1/namespaces/monitoring/services",
+	}, paths)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const exportedLabelPrefix = "exported_"
+
+// FederatedFamilies fixes up metric families scraped from the /federate
+// endpoint of a Prometheus server.
+//
+// When the labels of a series clashed with those of its target, Prometheus
+// kept them as exported_<label>, e.g. the namespace of each pod from
+// kube-state-metrics next to the namespace of kube-state-metrics itself.
+// Those get their original names back, replacing the target's.
+//
+// Federation doesn't say what type metrics are, so histograms and summaries
+// are put back together from their _bucket, _sum and _count series, and
+// _total series become counters. Other series are left untyped. Series
+// keep the timestamps Prometheus scraped them at.
+func FederatedFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	var result []*dto.MetricFamily
+	req := &WriteRequest{}
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.Label = restoreExportedLabels(m.Label)
+		}
+		if mf.GetType() != dto.MetricType_UNTYPED {
+			result = append(result, mf)
+			continue
+		}
+		names[mf.GetName()] = true
+		for _, m := range mf.Metric {
+			ts := &TimeSeries{
+				Labels:  []*Label{{Name: "__name__", Value: mf.GetName()}},
+				Samples: []*Sample{{Value: m.GetUntyped().GetValue(), Timestamp: m.GetTimestampMs()}},
+			}
+			for _, lp := range m.Label {
+				ts.Labels = append(ts.Labels, &Label{Name: lp.GetName(), Value: lp.GetValue()})
+			}
+			req.Timeseries = append(req.Timeseries, ts)
+		}
+	}
+
+	families := RemoteWriteFamilies(req, federatedTypes(mfs, names))
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			if m.GetTimestampMs() == 0 {
+				// The series had no timestamp
+				m.TimestampMs = nil
+			}
+		}
+	}
+	return append(result, families...)
+}
+
+// federatedTypes guesses the types of untyped families from their names and
+// labels, in the form RemoteWriteFamilies takes
+func federatedTypes(mfs []*dto.MetricFamily, names map[string]bool) map[string]int32 {
+	types := map[string]int32{}
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if !names[name] || len(mf.Metric) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, "_total"):
+			types[strings.TrimSuffix(name, "_total")] = MetricMetadataCounter
+		case strings.HasSuffix(name, "_bucket") && hasLabel(mf.Metric[0], "le"):
+			types[strings.TrimSuffix(name, "_bucket")] = MetricMetadataHistogram
+		case hasLabel(mf.Metric[0], "quantile") && (names[name+"_sum"] || names[name+"_count"]):
+			types[name] = MetricMetadataSummary
+		}
+	}
+	return types
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreExportedLabels renames exported_<label> to <label>, replacing any
+// label already called that
+func restoreExportedLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	exported := map[string]bool{}
+	for _, lp := range labels {
+		if strings.HasPrefix(lp.GetName(), exportedLabelPrefix) {
+			exported[strings.TrimPrefix(lp.GetName(), exportedLabelPrefix)] = true
+		}
+	}
+	if len(exported) == 0 {
+		return labels
+	}
+
+	result := make([]*dto.LabelPair, 0, len(labels))
+	for _, lp := range labels {
+		name := lp.GetName()
+		if strings.HasPrefix(name, exportedLabelPrefix) {
+			name = strings.TrimPrefix(name, exportedLabelPrefix)
+		} else if exported[name] {
+			continue
+		}
+		result = append(result, &dto.LabelPair{Name: proto.String(name), Value: lp.Value})
+	}
+	return result
+}
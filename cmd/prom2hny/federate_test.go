@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// As served by /federate, with the target labels of kube-state-metrics
+// itself clashing with those of its series
+const federationFixture = `# TYPE kube_pod_container_status_restarts_total untyped
+kube_pod_container_status_restarts_total{container="app",exported_namespace="default",exported_pod="web-1",instance="10.0.0.5:8080",job="kube-state-metrics",namespace="monitoring",pod="kube-state-metrics-0"} 3 1700000000000
+# TYPE kube_pod_status_ready untyped
+kube_pod_status_ready{condition="true",exported_namespace="default",exported_pod="web-1",instance="10.0.0.5:8080",job="kube-state-metrics",namespace="monitoring",pod="kube-state-metrics-0"} 1 1700000000000
+# TYPE http_request_duration_seconds_bucket untyped
+http_request_duration_seconds_bucket{instance="10.0.0.6:8080",job="web",le="+Inf"} 10 1700000001000
+http_request_duration_seconds_bucket{instance="10.0.0.6:8080",job="web",le="0.1"} 4 1700000001000
+# TYPE http_request_duration_seconds_count untyped
+http_request_duration_seconds_count{instance="10.0.0.6:8080",job="web"} 10 1700000001000
+# TYPE http_request_duration_seconds_sum untyped
+http_request_duration_seconds_sum{instance="10.0.0.6:8080",job="web"} 2.5 1700000001000
+# TYPE gc_duration_seconds untyped
+gc_duration_seconds{instance="10.0.0.6:8080",job="web",quantile="0.5"} 0.01 1700000001000
+# TYPE gc_duration_seconds_count untyped
+gc_duration_seconds_count{instance="10.0.0.6:8080",job="web"} 20 1700000001000
+# TYPE queue_length untyped
+queue_length{instance="10.0.0.6:8080",job="web"} 7 1700000001000
+`
+
+func TestFederatedFamilies(t *testing.T) {
+	mfs, err := ParseResponse("text/plain; version=0.0.4", strings.NewReader(federationFixture))
+	assert.NoError(t, err)
+	families := familiesByName(FederatedFamilies(mfs))
+	assert.Len(t, families, 5)
+
+	restarts := families["kube_pod_container_status_restarts_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, restarts.GetType())
+	assert.Equal(t, 3.0, restarts.Metric[0].GetCounter().GetValue())
+	assert.Equal(t, int64(1700000000000), restarts.Metric[0].GetTimestampMs())
+	assert.Equal(t, map[string]string{
+		"container": "app",
+		"instance":  "10.0.0.5:8080",
+		"job":       "kube-state-metrics",
+		"namespace": "default",
+		"pod":       "web-1",
+	}, makeLabels(restarts.Metric[0]))
+
+	assert.Equal(t, dto.MetricType_UNTYPED, families["kube_pod_status_ready"].GetType())
+	assert.Equal(t, "default", makeLabels(families["kube_pod_status_ready"].Metric[0])["namespace"])
+	assert.Equal(t, dto.MetricType_UNTYPED, families["queue_length"].GetType())
+
+	histogram := families["http_request_duration_seconds"]
+	if assert.Equal(t, dto.MetricType_HISTOGRAM, histogram.GetType()) {
+		h := histogram.Metric[0].GetHistogram()
+		assert.Equal(t, uint64(10), h.GetSampleCount())
+		assert.Equal(t, 2.5, h.GetSampleSum())
+		if assert.Len(t, h.Bucket, 2) {
+			assert.Equal(t, 0.1, h.Bucket[0].GetUpperBound())
+			assert.Equal(t, uint64(4), h.Bucket[0].GetCumulativeCount())
+		}
+	}
+	summary := families["gc_duration_seconds"]
+	if assert.Equal(t, dto.MetricType_SUMMARY, summary.GetType()) {
+		assert.Equal(t, uint64(20), summary.Metric[0].GetSummary().GetSampleCount())
+		assert.Len(t, summary.Metric[0].GetSummary().Quantile, 1)
+	}
+}
+
+func TestRestoreExportedLabels(t *testing.T) {
+	labels := []*dto.LabelPair{
+		{Name: proto.String("exported_exported_job"), Value: proto.String("app")},
+		{Name: proto.String("exported_job"), Value: proto.String("web")},
+		{Name: proto.String("instance"), Value: proto.String("a")},
+		{Name: proto.String("job"), Value: proto.String("federate")},
+	}
+	assert.Equal(t, map[string]string{
+		"job":          "web",
+		"exported_job": "app",
+		"instance":     "a",
+	}, makeLabels(&dto.Metric{Label: restoreExportedLabels(labels)}))
+}
+
+func TestScrapeFederation(t *testing.T) {
+	var matches []string
+	body := federationFixture
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matches = r.URL.Query()["match[]"]
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	sc := &ScrapeConfig{Match: []string{`{job="kube-state-metrics"}`, `{__name__=~"http_.*"}`}}
+	assert.NoError(t, sc.Init())
+	mfs, err := sc.Scrape(context.Background(), server.URL+"/federate")
+	assert.NoError(t, err)
+	assert.Equal(t, sc.Match, matches)
+
+	// Counter deltas go by the timestamps Prometheus scraped at
+	c := NewConverter(ConverterOptions{})
+	c.Convert(mfs, time.Now())
+	body = strings.Replace(federationFixture, "} 3 1700000000000", "} 5 1700000030000", 1)
+	mfs, err = sc.Scrape(context.Background(), server.URL+"/federate")
+	assert.NoError(t, err)
+	values := datapointValues(c.Convert(mfs, time.Now()))
+	assert.Equal(t, 2.0, values["kube_pod_container_status_restarts_total.delta"])
+	assert.InDelta(t, 2.0/30, values["kube_pod_container_status_restarts_total.rate"], 1e-9)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// ModeKubeStateMetrics groups kube_<group>_* metrics by the Kubernetes
+	// object they describe
+	ModeKubeStateMetrics = "kube-state-metrics"
+	// ModeGeneric groups series of any metric by their labels, so every
+	// distinct label set becomes one event
+	ModeGeneric = "generic"
+)
+
+func (c *Converter) isValueLabel(name string) bool {
+	for _, l := range c.options.ValueLabels {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getGenericGroup groups a series by its labels minus the value labels. The
+// group is named after the label names, e.g. device-instance, or target for
+// series without labels, which describe the target as a whole.
+func (c *Converter) getGenericGroup(m *dto.Metric) (string, string) {
+	const SEP = ":"
+	var names, pairs []string
+	for _, lp := range m.Label {
+		if c.isValueLabel(lp.GetName()) {
+			continue
+		}
+		names = append(names, lp.GetName())
+		pairs = append(pairs, lp.GetName()+"="+lp.GetValue())
+	}
+	if len(names) == 0 {
+		return "target", "target"
+	}
+	sort.Strings(names)
+	sort.Strings(pairs)
+
+	metricGroup := strings.Join(names, "-")
+	return metricGroup, metricGroup + SEP + strings.Join(pairs, SEP)
+}
+
+// foldValueLabels moves the value labels of m into the names of its
+// datapoints, so node_cpu_seconds_total{cpu="0",mode="idle"} with mode as a
+// value label becomes a node_cpu_seconds_total.idle field on the cpu="0"
+// event.
+func (c *Converter) foldValueLabels(metricName string, m *dto.Metric, dps []*DataPoint) {
+	var suffix string
+	labels := map[string]string{}
+	lps := append([]*dto.LabelPair{}, m.Label...)
+	sort.Slice(lps, func(i, j int) bool { return lps[i].GetName() < lps[j].GetName() })
+	for _, lp := range lps {
+		if c.isValueLabel(lp.GetName()) {
+			suffix += "." + lp.GetValue()
+		} else {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+	}
+
+	for _, dp := range dps {
+		if strings.HasPrefix(dp.Name, metricName) {
+			dp.Name = metricName + suffix + dp.Name[len(metricName):]
+		}
+		dp.Labels = labels
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const nodeExporterMetrics = `# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total{cpu="0",mode="idle"} %s
+node_cpu_seconds_total{cpu="0",mode="user"} %s
+node_cpu_seconds_total{cpu="1",mode="idle"} %s
+# TYPE node_filesystem_avail_bytes gauge
+node_filesystem_avail_bytes{device="/dev/sda1",mountpoint="/"} 1000
+node_filesystem_size_bytes{device="/dev/sda1",mountpoint="/"} 4000
+# TYPE node_load1 gauge
+node_load1 0.5
+# TYPE process_open_fds gauge
+process_open_fds 12
+`
+
+func TestGenericMode(t *testing.T) {
+	c := NewConverter(ConverterOptions{Mode: ModeGeneric, ValueLabels: []string{"mode"}})
+	start := time.Now()
+	convertText(c, fillValues(nodeExporterMetrics, "100", "10", "200"), start)
+	groups := convertText(c, fillValues(nodeExporterMetrics, "110", "15", "210"), start.Add(10*time.Second))
+
+	events := map[string]map[string]interface{}{}
+	for _, mg := range groups {
+		values := datapointValues([]*MetricGroup{mg})
+		for _, dp := range mg.DataPoints {
+			for k, v := range dp.Labels {
+				values[k] = v
+			}
+		}
+		events[mg.MetricGroup+"/"+mg.DataPoints[0].Labels["cpu"]] = values
+	}
+
+	assert.Len(t, events, 4)
+	assert.Equal(t, map[string]interface{}{
+		"cpu":                               "0",
+		"node_cpu_seconds_total.idle.delta": 10.0,
+		"node_cpu_seconds_total.idle.rate":  1.0,
+		"node_cpu_seconds_total.user.delta": 5.0,
+		"node_cpu_seconds_total.user.rate":  0.5,
+	}, events["cpu/0"])
+	assert.Equal(t, 10.0, events["cpu/1"]["node_cpu_seconds_total.idle.delta"])
+	assert.Equal(t, map[string]interface{}{
+		"device":                      "/dev/sda1",
+		"mountpoint":                  "/",
+		"node_filesystem_avail_bytes": 1000.0,
+		"node_filesystem_size_bytes":  4000.0,
+	}, events["device-mountpoint/"])
+	assert.Equal(t, map[string]interface{}{
+		"node_load1":       0.5,
+		"process_open_fds": 12.0,
+	}, events["target/"])
+}
+
+func TestGenericModeSkipsKubeStateMetricsRules(t *testing.T) {
+	const text = `# TYPE kube_pod_info gauge
+kube_pod_info{namespace="default",pod="app-1",node="node-1"} 1
+# TYPE kube_state_metrics_build_info gauge
+kube_state_metrics_build_info{version="v2.8.0"} 1
+`
+	c := NewConverter(ConverterOptions{Mode: ModeGeneric})
+	values := datapointValues(convertText(c, text, time.Now()))
+	assert.Equal(t, map[string]interface{}{
+		"kube_pod_info":                 1.0,
+		"kube_state_metrics_build_info": 1.0,
+	}, values)
+	assert.Equal(t, "", c.KubeStateMetricsVersion())
+}
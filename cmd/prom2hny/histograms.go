@@ -0,0 +1,181 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Percentiles estimated from histogram buckets
+var histogramQuantiles = []float64{0.5, 0.9, 0.99}
+
+type histogramState struct {
+	count   uint64
+	sum     float64
+	bounds  []float64
+	buckets []float64
+	created float64
+	time    time.Time
+}
+
+// quantileName formats a quantile as a percentile, e.g. 0.99 as p99 and
+// 0.999 as p999
+func quantileName(q float64) string {
+	if q >= 1 {
+		return "p100"
+	}
+	digits := strconv.FormatFloat(q, 'f', -1, 64)
+	if len(digits) < 2 || digits[:2] != "0." {
+		return "p0"
+	}
+	digits = digits[2:]
+	if len(digits) == 1 {
+		digits += "0"
+	}
+	return "p" + digits
+}
+
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// bucketQuantile estimates the q quantile from cumulative bucket counts the
+// same way Prometheus' histogram_quantile does: by interpolating linearly
+// within the bucket the quantile falls in. It returns false if there are no
+// observations.
+func bucketQuantile(q float64, bounds, counts []float64) (float64, bool) {
+	if len(counts) == 0 || !math.IsInf(bounds[len(bounds)-1], 1) {
+		return 0, false
+	}
+	total := counts[len(counts)-1]
+	if total == 0 {
+		return 0, false
+	}
+
+	rank := q * total
+	b := sort.Search(len(counts)-1, func(i int) bool { return counts[i] >= rank })
+	if b == len(counts)-1 {
+		// In the +Inf bucket, the best we can do is the highest finite bound
+		if b == 0 {
+			return 0, false
+		}
+		return bounds[b-1], true
+	}
+
+	lower, count := 0.0, counts[b]
+	if b > 0 {
+		lower = bounds[b-1]
+		count -= counts[b-1]
+		rank -= counts[b-1]
+	} else if bounds[0] <= 0 {
+		return bounds[0], true
+	}
+	if count == 0 {
+		return bounds[b], true
+	}
+	return lower + (bounds[b]-lower)*(rank/count), true
+}
+
+// histogramBuckets returns the bucket bounds and cumulative counts, making
+// sure the last bucket is +Inf
+func histogramBuckets(h *dto.Histogram) ([]float64, []float64) {
+	bounds := make([]float64, 0, len(h.Bucket)+1)
+	counts := make([]float64, 0, len(h.Bucket)+1)
+	buckets := append([]*dto.Bucket{}, h.Bucket...)
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].GetUpperBound() < buckets[j].GetUpperBound()
+	})
+	for _, b := range buckets {
+		bounds = append(bounds, b.GetUpperBound())
+		counts = append(counts, float64(b.GetCumulativeCount()))
+	}
+	if len(bounds) == 0 || !math.IsInf(bounds[len(bounds)-1], 1) {
+		bounds = append(bounds, math.Inf(1))
+		counts = append(counts, float64(h.GetSampleCount()))
+	}
+	return bounds, counts
+}
+
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getHistogramDatapoints returns <name>.count, <name>.sum and estimated
+// percentiles such as <name>.p99 over the lifetime of the histogram, and
+// <name>.count.delta, <name>.sum.delta and percentiles such as
+// <name>.p99.interval over the observations since the last scrape.
+func (c *Converter) getHistogramDatapoints(mf *dto.MetricFamily, m *dto.Metric, createdTimes map[string]map[string]float64, now time.Time) []*DataPoint {
+	name := mf.GetName()
+	labels := makeLabels(m)
+	h := m.GetHistogram()
+	bounds, counts := histogramBuckets(h)
+	state := &histogramState{
+		count:   h.GetSampleCount(),
+		sum:     h.GetSampleSum(),
+		bounds:  bounds,
+		buckets: counts,
+		time:    sampleTime(m, now),
+	}
+	created, hasCreated := createdTimes[createdName(name)][labelsKey(m)]
+	state.created = created
+
+	key := seriesKey(name, m)
+	prev, ok := c.prev[key].(*histogramState)
+	c.next[key] = state
+
+	dps := []*DataPoint{
+		{Name: name + ".count", Value: state.count, Labels: labels},
+		{Name: name + ".sum", Value: state.sum, Labels: labels},
+	}
+	for _, q := range histogramQuantiles {
+		if v, ok := bucketQuantile(q, bounds, counts); ok {
+			dps = append(dps, &DataPoint{Name: name + "." + quantileName(q), Value: v, Labels: labels})
+		}
+	}
+	if c.options.EmitBuckets {
+		for i, bound := range bounds {
+			dps = append(dps, &DataPoint{Name: name + ".bucket." + formatBound(bound), Value: counts[i], Labels: labels})
+		}
+	}
+
+	if !ok || !state.time.After(prev.time) {
+		return dps
+	}
+
+	// After a reset everything in the histogram is new
+	countDelta, sumDelta := state.count, state.sum
+	intervalCounts := counts
+	if state.count >= prev.count && sameBounds(bounds, prev.bounds) && !(hasCreated && created != prev.created) {
+		countDelta -= prev.count
+		sumDelta -= prev.sum
+		intervalCounts = make([]float64, len(counts))
+		for i := range counts {
+			intervalCounts[i] = counts[i] - prev.buckets[i]
+		}
+	}
+
+	dps = append(dps,
+		&DataPoint{Name: name + ".count.delta", Value: countDelta, Labels: labels},
+		&DataPoint{Name: name + ".sum.delta", Value: sumDelta, Labels: labels},
+	)
+	for _, q := range histogramQuantiles {
+		if v, ok := bucketQuantile(q, bounds, intervalCounts); ok {
+			dps = append(dps, &DataPoint{Name: name + "." + quantileName(q) + ".interval", Value: v, Labels: labels})
+		}
+	}
+	return dps
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	bounds := []float64{0.1, 0.5, 1, math.Inf(1)}
+
+	v, ok := bucketQuantile(0.5, bounds, []float64{10, 20, 40, 40})
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, v)
+	v, _ = bucketQuantile(0.375, bounds, []float64{10, 20, 40, 40})
+	assert.InDelta(t, 0.3, v, 1e-9)
+	v, _ = bucketQuantile(0.1, bounds, []float64{10, 20, 40, 40})
+	assert.InDelta(t, 0.04, v, 1e-9)
+	// Falls in the +Inf bucket
+	v, _ = bucketQuantile(0.99, bounds, []float64{10, 20, 40, 50})
+	assert.Equal(t, 1.0, v)
+
+	_, ok = bucketQuantile(0.5, bounds, []float64{0, 0, 0, 0})
+	assert.False(t, ok)
+}
+
+func TestQuantileName(t *testing.T) {
+	assert.Equal(t, "p50", quantileName(0.5))
+	assert.Equal(t, "p99", quantileName(0.99))
+	assert.Equal(t, "p999", quantileName(0.999))
+	assert.Equal(t, "p05", quantileName(0.05))
+	assert.Equal(t, "p100", quantileName(1))
+}
+
+func TestHistogramDatapoints(t *testing.T) {
+	const latency = `# TYPE kube_apiserver_request_duration_seconds histogram
+kube_apiserver_request_duration_seconds_bucket{verb="GET",le="0.1"} %d
+kube_apiserver_request_duration_seconds_bucket{verb="GET",le="1"} %d
+kube_apiserver_request_duration_seconds_bucket{verb="GET",le="+Inf"} %d
+kube_apiserver_request_duration_seconds_sum{verb="GET"} %d
+kube_apiserver_request_duration_seconds_count{verb="GET"} %d
+`
+	fill := func(values ...string) string {
+		text := latency
+		for _, v := range values {
+			text = strings.Replace(text, "%d", v, 1)
+		}
+		return text
+	}
+
+	c := NewConverter(ConverterOptions{EmitBuckets: true})
+	start := time.Now()
+	values := datapointValues(convertText(c, fill("10", "10", "10", "1", "10"), start))
+	assert.Equal(t, uint64(10), values["kube_apiserver_request_duration_seconds.count"])
+	assert.Equal(t, 1.0, values["kube_apiserver_request_duration_seconds.sum"])
+	assert.InDelta(t, 0.05, values["kube_apiserver_request_duration_seconds.p50"], 1e-9)
+	assert.Equal(t, 10.0, values["kube_apiserver_request_duration_seconds.bucket.+Inf"])
+	assert.NotContains(t, values, "kube_apiserver_request_duration_seconds.p50.interval")
+
+	// All 10 new observations were between 0.1 and 1
+	values = datapointValues(convertText(c, fill("10", "20", "20", "6", "20"), start.Add(time.Minute)))
+	assert.Equal(t, uint64(10), values["kube_apiserver_request_duration_seconds.count.delta"])
+	assert.Equal(t, 5.0, values["kube_apiserver_request_duration_seconds.sum.delta"])
+	assert.Equal(t, 0.1, values["kube_apiserver_request_duration_seconds.p50"])
+	assert.InDelta(t, 0.55, values["kube_apiserver_request_duration_seconds.p50.interval"], 1e-9)
+	assert.InDelta(t, 0.991, values["kube_apiserver_request_duration_seconds.p99.interval"], 1e-9)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// podFields are copied from pod events onto the events of their containers
+var podFields = []string{"node", "host_ip", "owner_kind", "owner_name", "workload_kind", "workload_name"}
+
+// ownerGroup is where to find the event of an object with owners of its
+// own. Owners are labeled owner_kind and owner_name, e.g. by
+// kube_replicaset_owner.
+type ownerGroup struct {
+	group     string
+	nameField string
+}
+
+// ownerGroups are the kinds of owners that have owners of their own
+var ownerGroups = map[string]ownerGroup{
+	"ReplicaSet": {group: "replicaset", nameField: "replicaset"},
+	"Job":        {group: "job", nameField: "job_name"},
+}
+
+// kubeObject is the event of a Kubernetes object, with the labels of its
+// datapoints merged the way ToEvent does
+type kubeObject struct {
+	mg     *MetricGroup
+	fields map[string]string
+	values map[string]interface{}
+}
+
+func newKubeObject(mg *MetricGroup) *kubeObject {
+	o := &kubeObject{
+		mg:     mg,
+		fields: map[string]string{},
+		values: map[string]interface{}{},
+	}
+	for _, dp := range mg.DataPoints {
+		if dp.Value != nil {
+			o.values[dp.Name] = dp.Value
+		}
+		for k, v := range dp.Labels {
+			o.fields[k] = v
+		}
+	}
+	return o
+}
+
+// add copies names from fields onto the event, without replacing the
+// fields it already has
+func (o *kubeObject) add(fields map[string]string, names []string) {
+	labels := map[string]string{}
+	for _, name := range names {
+		value, ok := fields[name]
+		if _, exists := o.fields[name]; !ok || exists {
+			continue
+		}
+		labels[name] = value
+		o.fields[name] = value
+	}
+	if len(labels) > 0 {
+		// Only contributes labels
+		o.mg.DataPoints = append(o.mg.DataPoints, &DataPoint{Labels: labels})
+	}
+}
+
+// addValues copies the values of datapoints whose names start with prefix
+// onto the event, without replacing the ones it already has
+func (o *kubeObject) addValues(values map[string]interface{}, prefix string) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if _, exists := o.values[name]; strings.HasPrefix(name, prefix) && !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o.values[name] = values[name]
+		o.mg.DataPoints = append(o.mg.DataPoints, &DataPoint{Name: name, Value: values[name]})
+	}
+}
+
+// kubeObjects indexes events by their group and the namespace and name of
+// the object they describe
+type kubeObjects map[string]*kubeObject
+
+func kubeObjectKey(group, namespace, name string) string {
+	return group + ":" + namespace + "/" + name
+}
+
+func (ko kubeObjects) get(group, namespace, name string) (*kubeObject, bool) {
+	o, ok := ko[kubeObjectKey(group, namespace, name)]
+	return o, ok
+}
+
+// joinMetricGroups copies fields between the events of related
+// kube-state-metrics objects, e.g. the node a pod runs on onto the events
+// of its containers, or the labels of a namespace onto the events of the
+// objects in it
+func (c *Converter) joinMetricGroups(metricGroups []*MetricGroup) {
+	objects := kubeObjects{}
+	var namespaced, pods, containers, claims []*kubeObject
+	for _, mg := range metricGroups {
+		o := newKubeObject(mg)
+		if _, ok := o.fields["namespace"]; ok && mg.MetricGroup != "namespace" {
+			namespaced = append(namespaced, o)
+		}
+		switch mg.MetricGroup {
+		case "namespace":
+			objects[kubeObjectKey(mg.MetricGroup, "", o.fields["namespace"])] = o
+		case "pod":
+			objects[kubeObjectKey(mg.MetricGroup, o.fields["namespace"], o.fields["pod"])] = o
+			pods = append(pods, o)
+		case "pod-container", "pod-init-container":
+			containers = append(containers, o)
+		case "persistentvolume":
+			objects[kubeObjectKey(mg.MetricGroup, "", o.fields["persistentvolume"])] = o
+		case "persistentvolumeclaim":
+			claims = append(claims, o)
+		default:
+			for _, og := range ownerGroups {
+				if og.group == mg.MetricGroup {
+					objects[kubeObjectKey(og.group, o.fields["namespace"], o.fields[og.nameField])] = o
+				}
+			}
+		}
+	}
+
+	for _, pod := range pods {
+		pod.add(objects.workload(pod), []string{"workload_kind", "workload_name"})
+	}
+
+	names := append([]string{}, podFields...)
+	for _, l := range c.options.PodLabels {
+		names = append(names, kubeLabelField(l))
+	}
+	for _, container := range containers {
+		if pod, ok := objects.get("pod", container.fields["namespace"], container.fields["pod"]); ok {
+			container.add(pod.fields, names)
+		}
+	}
+
+	joinVolumes(objects, pods, claims)
+
+	if len(c.options.NamespaceLabels) == 0 {
+		return
+	}
+	names = make([]string, 0, len(c.options.NamespaceLabels))
+	for _, l := range c.options.NamespaceLabels {
+		names = append(names, "namespace_"+kubeLabelField(l))
+	}
+	for _, o := range namespaced {
+		ns, ok := objects.get("namespace", "", o.fields["namespace"])
+		if !ok {
+			continue
+		}
+		fields := make(map[string]string, len(ns.fields))
+		for k, v := range ns.fields {
+			fields["namespace_"+k] = v
+		}
+		o.add(fields, names)
+	}
+}
+
+// joinVolumes adds the persistent volume each claim is bound to, with its
+// values as they are and its labels prefixed persistentvolume_, and the pods
+// that mount the claim, e.g. to find the workload waiting for a Pending claim
+func joinVolumes(objects kubeObjects, pods, claims []*kubeObject) {
+	if len(claims) == 0 {
+		return
+	}
+
+	// Pods have one kube_pod_spec_volumes_persistentvolumeclaims_info series
+	// per claim they mount
+	mounts := map[string][]*kubeObject{}
+	for _, pod := range pods {
+		for _, dp := range pod.mg.DataPoints {
+			if dp.Name != "kube_pod_spec_volumes_persistentvolumeclaims_info" {
+				continue
+			}
+			key := kubeObjectKey("persistentvolumeclaim", pod.fields["namespace"], dp.Labels["persistentvolumeclaim"])
+			mounts[key] = append(mounts[key], pod)
+		}
+	}
+
+	for _, claim := range claims {
+		namespace, name := claim.fields["namespace"], claim.fields["persistentvolumeclaim"]
+		if pv, ok := objects.get("persistentvolume", "", claim.fields["volumename"]); ok {
+			claim.addValues(pv.values, "kube_persistentvolume_")
+			fields := make(map[string]string, len(pv.fields))
+			names := make([]string, 0, len(pv.fields))
+			for k, v := range pv.fields {
+				if k != "persistentvolume" {
+					fields["persistentvolume_"+k] = v
+					names = append(names, "persistentvolume_"+k)
+				}
+			}
+			sort.Strings(names)
+			claim.add(fields, names)
+		}
+
+		var podNames, workloads []string
+		seen := map[string]bool{}
+		for _, pod := range mounts[kubeObjectKey("persistentvolumeclaim", namespace, name)] {
+			podNames = append(podNames, pod.fields["pod"])
+			if kind := pod.fields["workload_kind"]; kind != "" {
+				workload := kind + "/" + pod.fields["workload_name"]
+				if !seen[workload] {
+					seen[workload] = true
+					workloads = append(workloads, workload)
+				}
+			}
+		}
+		if len(podNames) == 0 {
+			continue
+		}
+		sort.Strings(podNames)
+		sort.Strings(workloads)
+		fields := map[string]string{"mounted_by_pods": strings.Join(podNames, ",")}
+		if len(workloads) > 0 {
+			fields["mounted_by_workloads"] = strings.Join(workloads, ",")
+		}
+		claim.add(fields, []string{"mounted_by_pods", "mounted_by_workloads"})
+	}
+}
+
+// workload follows the owners of o up to the top-level workload that
+// manages it, e.g. the Deployment of a pod's ReplicaSet, or the CronJob of
+// its Job. Owners without an event are taken as top-level.
+func (ko kubeObjects) workload(o *kubeObject) map[string]string {
+	kind, name := o.fields["owner_kind"], o.fields["owner_name"]
+	if kind == "" || kind == "<none>" {
+		return nil
+	}
+	namespace := o.fields["namespace"]
+	// Bounded in case of an ownership cycle
+	for i := 0; i < len(ownerGroups); i++ {
+		og, ok := ownerGroups[kind]
+		if !ok {
+			break
+		}
+		owner, ok := ko.get(og.group, namespace, name)
+		if !ok || owner.fields["owner_kind"] == "" || owner.fields["owner_kind"] == "<none>" {
+			break
+		}
+		kind, name = owner.fields["owner_kind"], owner.fields["owner_name"]
+	}
+	return map[string]string{"workload_kind": kind, "workload_name": name}
+}
+
+// kubeLabelField is the field kube-state-metrics puts a Kubernetes label
+// in, e.g. label_app_kubernetes_io_name for app.kubernetes.io/name
+func kubeLabelField(label string) string {
+	return "label_" + invalidNameChars.ReplaceAllString(label, "_")
+}
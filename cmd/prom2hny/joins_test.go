@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventFields returns the fields ToEvent would send for each event, by
+// metric group and object
+func eventFields(metricGroups []*MetricGroup, nameField string) map[string]map[string]interface{} {
+	result := map[string]map[string]interface{}{}
+	for _, mg := range metricGroups {
+		fields := map[string]interface{}{}
+		for _, dp := range mg.DataPoints {
+			if dp.Value != nil {
+				fields[dp.Name] = dp.Value
+			}
+			for k, v := range dp.Labels {
+				fields[k] = v
+			}
+		}
+		name, _ := fields[nameField].(string)
+		result[mg.MetricGroup+":"+name] = fields
+	}
+	return result
+}
+
+func TestJoinPodContainers(t *testing.T) {
+	const metrics = `kube_pod_info{namespace="default",pod="web-1",host_ip="10.0.0.1",node="n1"} 1
+kube_pod_labels{namespace="default",pod="web-1",label_app="web",label_app_kubernetes_io_name="web",label_pod_template_hash="abc"} 1
+kube_pod_owner{namespace="default",pod="web-1",owner_kind="ReplicaSet",owner_name="web-abc",owner_is_controller="true"} 1
+kube_pod_container_status_restarts{namespace="default",pod="web-1",container="app"} 3
+kube_pod_init_container_status_running{namespace="default",pod="web-1",container="init"} 0
+kube_pod_container_status_restarts{namespace="default",pod="gone",container="app"} 1
+`
+	c := NewConverter(ConverterOptions{PodLabels: []string{"app.kubernetes.io/name", "missing"}})
+	events := eventFields(convertText(c, metrics, time.Now()), "pod")
+
+	for _, group := range []string{"pod-container", "pod-init-container"} {
+		fields := events[group+":web-1"]
+		assert.Equal(t, "n1", fields["node"], group)
+		assert.Equal(t, "10.0.0.1", fields["host_ip"], group)
+		assert.Equal(t, "ReplicaSet", fields["owner_kind"], group)
+		assert.Equal(t, "web-abc", fields["owner_name"], group)
+		assert.Equal(t, "web", fields["label_app_kubernetes_io_name"], group)
+		assert.NotContains(t, fields, "label_app", group)
+		assert.NotContains(t, fields, "label_missing", group)
+	}
+
+	// Nothing to join for containers whose pod isn't in the scrape
+	assert.NotContains(t, events["pod-container:gone"], "node")
+}
+
+func TestJoinWorkloads(t *testing.T) {
+	const metrics = `kube_pod_owner{namespace="default",pod="web-abc-1",owner_kind="ReplicaSet",owner_name="web-abc"} 1
+kube_pod_container_status_restarts{namespace="default",pod="web-abc-1",container="app"} 0
+kube_replicaset_owner{namespace="default",replicaset="web-abc",owner_kind="Deployment",owner_name="web"} 1
+kube_pod_owner{namespace="default",pod="backup-1-x",owner_kind="Job",owner_name="backup-1"} 1
+kube_job_owner{namespace="default",job_name="backup-1",owner_kind="CronJob",owner_name="backup"} 1
+kube_pod_owner{namespace="default",pod="db-0",owner_kind="StatefulSet",owner_name="db"} 1
+kube_pod_owner{namespace="default",pod="orphan-rs-1",owner_kind="ReplicaSet",owner_name="orphan-rs"} 1
+kube_replicaset_owner{namespace="default",replicaset="orphan-rs",owner_kind="<none>",owner_name="<none>"} 1
+kube_pod_owner{namespace="default",pod="static",owner_kind="<none>",owner_name="<none>"} 1
+`
+	events := eventFields(convertText(NewConverter(ConverterOptions{}), metrics, time.Now()), "pod")
+	for pod, workload := range map[string][2]string{
+		"pod:web-abc-1":           {"Deployment", "web"},
+		"pod-container:web-abc-1": {"Deployment", "web"},
+		"pod:backup-1-x":          {"CronJob", "backup"},
+		"pod:db-0":                {"StatefulSet", "db"},
+		"pod:orphan-rs-1":         {"ReplicaSet", "orphan-rs"},
+	} {
+		assert.Equal(t, workload[0], events[pod]["workload_kind"], pod)
+		assert.Equal(t, workload[1], events[pod]["workload_name"], pod)
+	}
+	assert.NotContains(t, events["pod:static"], "workload_kind")
+}
+
+func TestJoinNamespaceLabels(t *testing.T) {
+	const metrics = `kube_namespace_labels{namespace="shop",label_team="payments",label_cost_center="42",label_other="x"} 1
+kube_namespace_status_phase{namespace="shop",phase="Active"} 1
+kube_deployment_spec_replicas{namespace="shop",deployment="web"} 2
+kube_pod_container_status_restarts{namespace="shop",pod="web-1",container="app"} 0
+kube_deployment_spec_replicas{namespace="other",deployment="web"} 1
+kube_node_spec_unschedulable{node="n1"} 0
+`
+	c := NewConverter(ConverterOptions{NamespaceLabels: []string{"team", "cost-center"}})
+	groups := convertText(c, metrics, time.Now())
+	events := eventFields(groups, "namespace")
+	for _, group := range []string{"deployment:shop", "pod-container:shop"} {
+		assert.Equal(t, "payments", events[group]["namespace_label_team"], group)
+		assert.Equal(t, "42", events[group]["namespace_label_cost_center"], group)
+		assert.NotContains(t, events[group], "namespace_label_other", group)
+	}
+	assert.NotContains(t, events["deployment:other"], "namespace_label_team")
+	assert.NotContains(t, events["namespace:shop"], "namespace_label_team")
+	assert.NotContains(t, events["node:"], "namespace_label_team")
+}
+
+func TestJoinVolumes(t *testing.T) {
+	const metrics = `kube_persistentvolumeclaim_info{namespace="db",persistentvolumeclaim="data-db-0",storageclass="ssd",volumename="pv-1"} 1
+kube_persistentvolumeclaim_status_phase{namespace="db",persistentvolumeclaim="data-db-0",phase="Bound"} 1
+kube_persistentvolumeclaim_info{namespace="db",persistentvolumeclaim="data-db-1",storageclass="ssd",volumename=""} 1
+kube_persistentvolumeclaim_status_phase{namespace="db",persistentvolumeclaim="data-db-1",phase="Pending"} 1
+kube_persistentvolumeclaim_status_phase{namespace="db",persistentvolumeclaim="data-db-1",phase="Bound"} 0
+kube_persistentvolume_info{persistentvolume="pv-1",storageclass="ssd",csi_driver="ebs.csi.aws.com"} 1
+kube_persistentvolume_capacity_bytes{persistentvolume="pv-1"} 1e+10
+kube_persistentvolume_reclaim_policy{persistentvolume="pv-1",reclaim_policy="Retain"} 1
+kube_persistentvolume_reclaim_policy{persistentvolume="pv-1",reclaim_policy="Delete"} 0
+kube_persistentvolume_status_phase{persistentvolume="pv-1",phase="Bound"} 1
+kube_persistentvolume_status_phase{persistentvolume="pv-1",phase="Released"} 0
+kube_pod_owner{namespace="db",pod="db-0",owner_kind="StatefulSet",owner_name="db"} 1
+kube_pod_spec_volumes_persistentvolumeclaims_info{namespace="db",pod="db-0",volume="data",persistentvolumeclaim="data-db-0"} 1
+kube_pod_owner{namespace="db",pod="db-1",owner_kind="StatefulSet",owner_name="db"} 1
+kube_pod_spec_volumes_persistentvolumeclaims_info{namespace="db",pod="db-1",volume="data",persistentvolumeclaim="data-db-1"} 1
+kube_pod_spec_volumes_persistentvolumeclaims_info{namespace="db",pod="backup",volume="data",persistentvolumeclaim="data-db-1"} 1
+`
+	events := eventFields(convertText(NewConverter(ConverterOptions{}), metrics, time.Now()), "persistentvolumeclaim")
+
+	bound := events["persistentvolumeclaim:data-db-0"]
+	assert.Equal(t, "Bound", bound["kube_persistentvolumeclaim_status_phase"])
+	assert.Equal(t, 1e10, bound["kube_persistentvolume_capacity_bytes"])
+	assert.Equal(t, "Bound", bound["kube_persistentvolume_status_phase"])
+	assert.Equal(t, "Retain", bound["kube_persistentvolume_reclaim_policy"])
+	assert.Equal(t, "ssd", bound["persistentvolume_storageclass"])
+	assert.Equal(t, "ebs.csi.aws.com", bound["persistentvolume_csi_driver"])
+	assert.Equal(t, "db-0", bound["mounted_by_pods"])
+	assert.Equal(t, "StatefulSet/db", bound["mounted_by_workloads"])
+
+	pending := events["persistentvolumeclaim:data-db-1"]
+	assert.Equal(t, "Pending", pending["kube_persistentvolumeclaim_status_phase"])
+	assert.NotContains(t, pending, "kube_persistentvolume_capacity_bytes")
+	assert.NotContains(t, pending, "persistentvolume_storageclass")
+	assert.Equal(t, "backup,db-1", pending["mounted_by_pods"])
+	assert.Equal(t, "StatefulSet/db", pending["mounted_by_workloads"])
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// kubeStateMetricsBuildInfo reports the version of kube-state-metrics v2.0
+// and up
+const kubeStateMetricsBuildInfo = "kube_state_metrics_build_info"
+
+// Major versions of kube-state-metrics with their own value rules
+const (
+	KubeStateMetricsV0 = "v0"
+	KubeStateMetricsV1 = "v1"
+	KubeStateMetricsV2 = "v2"
+)
+
+var commonValueRules = []*ValueRule{
+	{Match: `kube_pod_status_phase|kube_persistentvolumeclaim_status_phase|kube_persistentvolume_status_phase`, Type: ValueRuleLabelValue, Label: "phase"},
+	{Match: `kube_persistentvolume_reclaim_policy`, Type: ValueRuleLabelValue, Label: "reclaim_policy"},
+	{Match: `kube_pod_labels|kube_pod_info|kube_service_info|kube_pod_container_info|kube_pod_init_container_info|kube_persistentvolumeclaim_info|kube_persistentvolume_info|kube_cronjob_info|kube_node_labels|kube_service_labels|kube_statefulset_labels`, Type: ValueRuleLabelsOnly},
+	{Match: `kube_.+_annotations`, Type: ValueRuleLabelsOnly},
+	{Match: `kube_pod_status_ready|kube_pod_status_scheduled`, Type: ValueRuleLabelValue, Label: "condition"},
+	{Match: `kube_job_complete|kube_job_failed`, Type: ValueRuleLabelValue, Label: "condition"},
+	{Match: `kube_pod_status_reason|kube_pod_(init_)?container_status_(waiting|terminated|last_terminated)_reason`, Type: ValueRuleLabelValue, Label: "reason"},
+}
+
+// Formatted as Condition Values (kube-state-metrics v0.5 and prior)
+var v0ValueRules = []*ValueRule{
+	{Match: `kube_node_status_disk_pressure|kube_node_status_memory_pressure|kube_node_status_out_of_disk|kube_node_status_ready`, Type: ValueRuleLabelValue, Label: "condition"},
+}
+
+// kube-state-metrics v1.0 and up. Resources are also labels from v1.5.
+var v1ValueRules = []*ValueRule{
+	{Match: `kube_(.+)_status_condition`, Type: ValueRuleRenameByLabel, Label: "status", Name: "kube_${1}_status_${condition}"},
+	{Match: `kube_node_status_(allocatable|capacity)|kube_pod_(init_)?container_resource_(requests|limits)`, Type: ValueRuleRename, Name: "${0}_${resource}_${unit}"},
+}
+
+// kube-state-metrics v2.0 and up
+var v2ValueRules = []*ValueRule{
+	{Match: `kube_horizontalpodautoscaler_(spec|status)_target_metric`, Type: ValueRuleRename, Name: "${0}_${metric_name}_${metric_target_type}"},
+}
+
+// KubeStateMetricsValueRules are the built-in value rules for each major
+// version of kube-state-metrics
+var KubeStateMetricsValueRules = map[string][]*ValueRule{
+	KubeStateMetricsV0: concatValueRules(commonValueRules, v0ValueRules),
+	KubeStateMetricsV1: concatValueRules(commonValueRules, v1ValueRules),
+	KubeStateMetricsV2: concatValueRules(commonValueRules, v1ValueRules, v2ValueRules),
+}
+
+// DefaultValueRules are used when the version of kube-state-metrics can't
+// be detected, and cover every version
+var DefaultValueRules = concatValueRules(commonValueRules, v0ValueRules, v1ValueRules, v2ValueRules)
+
+func init() {
+	for _, rules := range [][]*ValueRule{commonValueRules, v0ValueRules, v1ValueRules, v2ValueRules} {
+		for _, r := range rules {
+			mustCompile(r)
+		}
+	}
+}
+
+func concatValueRules(ruleSets ...[]*ValueRule) []*ValueRule {
+	var result []*ValueRule
+	for _, rules := range ruleSets {
+		result = append(result, rules...)
+	}
+	return result
+}
+
+// resourceFamilies have a series per resource in kube-state-metrics v1.5
+// and up, e.g. kube_node_status_allocatable{resource="cpu",unit="core"}.
+// Before v2.0 each resource also had a family of its own, e.g.
+// kube_node_status_allocatable_cpu_cores.
+var resourceFamilies = regexp.MustCompile(`^kube_(node_status_(allocatable|capacity)|pod_(init_)?container_resource_(requests|limits))(_.+)?$`)
+
+// detectKubeStateMetricsVersion returns the version reported by
+// kube_state_metrics_build_info, e.g. v2.8.0, and its major version. Older
+// versions don't report one, so their major version is guessed from the
+// families present, and also used as the version. Both are empty if mfs
+// don't come from kube-state-metrics.
+func detectKubeStateMetricsVersion(mfs []*dto.MetricFamily) (string, string) {
+	names := make(map[string]bool, len(mfs))
+	var resourceLabels, resourceNames bool
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+		if submatches := resourceFamilies.FindStringSubmatch(mf.GetName()); submatches != nil {
+			if submatches[5] != "" {
+				resourceNames = true
+			} else if len(mf.Metric) > 0 && makeLabels(mf.Metric[0])["resource"] != "" {
+				resourceLabels = true
+			}
+		}
+		if mf.GetName() != kubeStateMetricsBuildInfo {
+			continue
+		}
+		for _, m := range mf.Metric {
+			version := makeLabels(m)["version"]
+			major := "v" + strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0]
+			if KubeStateMetricsValueRules[major] != nil {
+				return version, major
+			}
+		}
+	}
+
+	switch {
+	// Resources are only labels from v2.0
+	case resourceLabels && !resourceNames:
+		return KubeStateMetricsV2, KubeStateMetricsV2
+	case resourceLabels || names["kube_node_status_condition"]:
+		return KubeStateMetricsV1, KubeStateMetricsV1
+	case names["kube_node_status_ready"]:
+		return KubeStateMetricsV0, KubeStateMetricsV0
+	}
+	return "", ""
+}
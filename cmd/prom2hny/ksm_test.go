@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectKubeStateMetricsVersion(t *testing.T) {
+	for _, tc := range []struct {
+		metrics, version, major string
+	}{
+		{`kube_state_metrics_build_info{version="v2.8.0"} 1`, "v2.8.0", KubeStateMetricsV2},
+		{`kube_state_metrics_build_info{version="1.9.8"} 1`, "1.9.8", KubeStateMetricsV1},
+		{`kube_node_status_allocatable{node="n1",resource="cpu",unit="core"} 2`, KubeStateMetricsV2, KubeStateMetricsV2},
+		{`kube_node_status_condition{node="n1",condition="Ready",status="true"} 1`, KubeStateMetricsV1, KubeStateMetricsV1},
+		// v1.5 to v1.9 have resources both as labels and in family names
+		{`kube_pod_container_resource_requests{namespace="default",pod="web-1",container="app",node="n1",resource="cpu",unit="core"} 0.5
+kube_pod_container_resource_requests_cpu_cores{namespace="default",pod="web-1",container="app",node="n1"} 0.5`, KubeStateMetricsV1, KubeStateMetricsV1},
+		{`kube_node_status_allocatable{node="n1",resource="cpu",unit="core"} 2
+kube_node_status_allocatable_cpu_cores{node="n1"} 2
+kube_node_status_condition{node="n1",condition="Ready",status="true"} 1`, KubeStateMetricsV1, KubeStateMetricsV1},
+		{`kube_node_status_ready{node="n1",condition="true"} 1`, KubeStateMetricsV0, KubeStateMetricsV0},
+		{`node_load1 0.5`, "", ""},
+	} {
+		mfs, _ := ParseResponse("text/plain", strings.NewReader(tc.metrics+"\n"))
+		version, major := detectKubeStateMetricsVersion(mfs)
+		assert.Equal(t, tc.version, version, tc.metrics)
+		assert.Equal(t, tc.major, major, tc.metrics)
+	}
+}
+
+func TestKubeStateMetricsVersionRules(t *testing.T) {
+	// kube_node_status_ready is only a condition value before v1.0
+	const metrics = `kube_state_metrics_build_info{version="v1.9.8"} 1
+kube_node_status_ready{node="n1",condition="true"} 1
+`
+	c := NewConverter(ConverterOptions{})
+	groups := convertText(c, metrics, time.Now())
+	assert.Equal(t, map[string]interface{}{
+		"kube_node_status_ready":     1.0,
+		"kube_state_metrics_version": "v1.9.8",
+	}, datapointValues(groups))
+	assert.Equal(t, "v1.9.8", c.KubeStateMetricsVersion())
+
+	// v1.9 has resources both as labels and in family names
+	groups = convertText(c, `kube_node_status_allocatable{node="n1",resource="cpu",unit="core"} 2
+kube_node_status_allocatable_cpu_cores{node="n1"} 2
+`, time.Now())
+	assert.Equal(t, map[string]interface{}{
+		"kube_node_status_allocatable_cpu_core":  2.0,
+		"kube_node_status_allocatable_cpu_cores": 2.0,
+		"kube_state_metrics_version":             KubeStateMetricsV1,
+	}, datapointValues(groups))
+
+	// Older versions are recognized by their metrics
+	groups = convertText(c, `kube_node_status_ready{node="n1",condition="true"} 1
+`, time.Now())
+	assert.Equal(t, map[string]interface{}{
+		"kube_node_status_ready":     "true",
+		"kube_state_metrics_version": KubeStateMetricsV0,
+	}, datapointValues(groups))
+
+	groups = convertText(c, "node_load1 0.5\n", time.Now())
+	assert.Empty(t, groups)
+	assert.Equal(t, "", c.KubeStateMetricsVersion())
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -19,19 +22,107 @@ import (
 	"github.com/prometheus/common/expfmt"
 )
 
-const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+const acceptHeader = `application/openmetrics-text;version=1.0.0;q=0.8,application/openmetrics-text;version=0.0.1;q=0.75,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
 
 type Options struct {
-	URL      string `long:"url"`
-	Dataset  string `long:"dataset"`
-	Writekey string `long:"writekey"`
-	APIHost  string `long:"apihost" default:"https://api.honeycomb.io"`
-	Interval int    `long:"interval" default:"60"`
+	URLs     []string `long:"url"`
+	Dataset  string   `long:"dataset"`
+	Writekey string   `long:"writekey"`
+	APIHost  string   `long:"apihost" default:"https://api.honeycomb.io"`
+	Interval int      `long:"interval" default:"60"`
+
+	KubernetesSD         bool     `long:"kubernetes-sd"`
+	KubernetesAPIServer  string   `long:"kubernetes-api-server"`
+	KubernetesNamespaces []string `long:"kubernetes-namespace"`
+	RefreshInterval      int      `long:"refresh-interval" default:"30"`
+
+	FileSD         []string `long:"file-sd"`
+	FileSDInterval int      `long:"file-sd-interval" default:"5"`
+
+	HTTPSD         []string `long:"http-sd"`
+	HTTPSDInterval int      `long:"http-sd-interval" default:"60"`
+
+	// Scrape settings for targets not defined in --config. Jobs in --config
+	// inherit the timeout and backoff if they don't set their own.
+	ScrapeTimeout      int    `long:"scrape-timeout" default:"10"`
+	ScrapeRetries      int    `long:"scrape-retries" default:"0"`
+	RetryBackoff       int    `long:"retry-backoff" default:"1"`
+	BearerToken        string `long:"bearer-token"`
+	BearerTokenFile    string `long:"bearer-token-file"`
+	BasicAuthUsername  string `long:"basic-auth-username"`
+	BasicAuthPassword  string `long:"basic-auth-password"`
+	CAFile             string `long:"ca-file"`
+	CertFile           string `long:"cert-file"`
+	KeyFile            string `long:"key-file"`
+	InsecureSkipVerify bool   `long:"insecure-skip-verify"`
+
+	// Selectors sent to the /federate endpoint of --url targets. Other
+	// targets are scraped as-is.
+	FederateMatch []string `long:"federate-match"`
+
+	ConfigFile string `long:"config"`
+
+	CounterCumulative bool `long:"counter-cumulative"`
+	HistogramBuckets  bool `long:"histogram-buckets"`
+	SummaryDeltas     bool `long:"summary-deltas"`
+
+	UntypedCounters []string `long:"untyped-counter"`
+
+	Mode        string   `long:"mode" default:"kube-state-metrics" choice:"kube-state-metrics" choice:"generic"`
+	ValueLabels []string `long:"value-label"`
+
+	PodLabels       []string `long:"pod-label"`
+	NamespaceLabels []string `long:"namespace-label"`
+
+	// Receivers for pushed metrics, all served on Listen
+	Listen                    string `long:"listen" default:":9201"`
+	RemoteWrite               bool   `long:"remote-write"`
+	Push                      bool   `long:"push"`
+	PushSend                  string `long:"push-send" default:"immediate" choice:"immediate" choice:"interval"`
+	PushRetention             int    `long:"push-retention" default:"0"`
+	OTLP                      bool   `long:"otlp"`
+	ReceiverBearerToken       string `long:"receiver-bearer-token"`
+	ReceiverBasicAuthUsername string `long:"receiver-basic-auth-username"`
+	ReceiverBasicAuthPassword string `long:"receiver-basic-auth-password"`
+	MaxInflightRequests       int    `long:"max-inflight-requests" default:"10"`
+}
+
+// receiving is whether any receiver for pushed metrics is enabled
+func (o *Options) receiving() bool {
+	return o.RemoteWrite || o.Push || o.OTLP
+}
+
+// defaultScrapeConfig builds the scrape config used for targets given on
+// the command line or found by discovery outside of --config
+func (o *Options) defaultScrapeConfig() *ScrapeConfig {
+	sc := &ScrapeConfig{
+		ScrapeTimeout:   time.Duration(o.ScrapeTimeout) * time.Second,
+		Retries:         o.ScrapeRetries,
+		RetryBackoff:    time.Duration(o.RetryBackoff) * time.Second,
+		BearerToken:     o.BearerToken,
+		BearerTokenFile: o.BearerTokenFile,
+		TLSConfig: TLSConfig{
+			CAFile:             o.CAFile,
+			CertFile:           o.CertFile,
+			KeyFile:            o.KeyFile,
+			InsecureSkipVerify: o.InsecureSkipVerify,
+		},
+	}
+	if o.BasicAuthUsername != "" {
+		sc.BasicAuth = &BasicAuth{
+			Username: o.BasicAuthUsername,
+			Password: o.BasicAuthPassword,
+		}
+	}
+	return sc
 }
 
 type MetricGroup struct {
 	DataPoints  []*DataPoint
 	MetricGroup string
+	// Labels are attached to the event as-is, e.g. the target the group
+	// was scraped from
+	Labels map[string]string
 }
 
 type DataPoint struct {
@@ -40,25 +131,137 @@ type DataPoint struct {
 	Labels map[string]string
 }
 
+// NewMetricGroups converts metric families without any state from earlier
+// scrapes. Use a Converter to get per-interval values for counters.
 func NewMetricGroups(mfs []*dto.MetricFamily) []*MetricGroup {
+	return NewConverter(ConverterOptions{}).Convert(mfs, time.Now())
+}
+
+type ConverterOptions struct {
+	// How series are grouped into events, ModeKubeStateMetrics by default
+	Mode string
+	// Rules tried in order to group each metric. Metrics no rule matches are
+	// dropped, or grouped by their labels in ModeGeneric. Defaults to
+	// DefaultGroupRules outside of ModeGeneric.
+	GroupRules []*GroupRule
+	// In ModeGeneric, labels that are folded into field names instead of
+	// being used to group series
+	ValueLabels []string
+	// Rules tried in order to turn the value of each gauge into a field,
+	// before the KubeStateMetricsValueRules for the version of
+	// kube-state-metrics that's detected, or DefaultValueRules. Only these
+	// are used in ModeGeneric. Gauges no rule matches keep their value.
+	ValueRules               []*ValueRule
+	DisableDefaultValueRules bool
+
+	// Also emit the cumulative value of counters under their own name
+	EmitCumulative bool
+	// Emit the cumulative count of each histogram bucket
+	EmitBuckets bool
+	// Emit the change in summary counts and sums since the last scrape
+	EmitSummaryDeltas bool
+	// Untyped metrics are treated as gauges, unless their name matches one
+	// of these
+	UntypedCounters []*regexp.Regexp
+
+	// Kubernetes labels of pods copied onto the events of their containers,
+	// along with the node, host IP and owner of the pod
+	PodLabels []string
+	// Kubernetes labels of namespaces copied onto the events of every
+	// object in them, as namespace_label_<name>
+	NamespaceLabels []string
+}
+
+// Converter turns metric families into metric groups. It remembers
+// cumulative values between calls to Convert, so it should be used for a
+// single source of metrics, e.g. one scrape target.
+type Converter struct {
+	options ConverterOptions
+
+	mtx sync.Mutex
+	// State of cumulative series by seriesKey, from the previous and the
+	// current call to Convert
+	prev map[string]interface{}
+	next map[string]interface{}
+	// Version of kube-state-metrics the last metrics came from, if any
+	kubeStateMetricsVersion string
+}
+
+func NewConverter(options ConverterOptions) *Converter {
+	return &Converter{
+		options: options,
+		prev:    make(map[string]interface{}),
+	}
+}
+
+// Convert builds metric groups from mfs. now is used as the time of samples
+// without a timestamp.
+func (c *Converter) Convert(mfs []*dto.MetricFamily, now time.Time) []*MetricGroup {
+	return c.convert(mfs, now, nil)
+}
+
+// convert is Convert for families that may include gauges of fields worked
+// out before conversion, such as the x_total.delta of OTLP delta sums.
+// fieldOf names the metric each of those belongs to, so value labels are
+// folded in after its name rather than the field's.
+func (c *Converter) convert(mfs []*dto.MetricFamily, now time.Time, fieldOf map[string]string) []*MetricGroup {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
 	metricGroupsMap := make(map[string]*MetricGroup)
+	mfs = c.resolveUntyped(mfs)
+	createdTimes := getCreatedTimes(mfs)
+	c.next = make(map[string]interface{}, len(c.prev))
+
+	generic := c.options.Mode == ModeGeneric
+	groupRules := c.options.GroupRules
+	if groupRules == nil && !generic {
+		groupRules = DefaultGroupRules
+	}
+	// Metrics in ModeGeneric aren't treated as coming from
+	// kube-state-metrics, even if they look like they do
+	var version, major string
+	if !generic {
+		version, major = detectKubeStateMetricsVersion(mfs)
+	}
+	c.kubeStateMetricsVersion = version
+	valueRules := c.options.ValueRules
+	if !c.options.DisableDefaultValueRules && !generic {
+		defaults, ok := KubeStateMetricsValueRules[major]
+		if !ok {
+			defaults = DefaultValueRules
+		}
+		valueRules = concatValueRules(valueRules, defaults)
+	}
 
 	for _, mf := range mfs {
-		if mf.GetType() != dto.MetricType_GAUGE {
+		if mf.GetName() == kubeStateMetricsBuildInfo && !generic {
+			// Emitted as kube_state_metrics_version instead
+			continue
+		}
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			if _, ok := createdTimes[mf.GetName()]; ok {
+				// Only used to detect resets
+				continue
+			}
+		case dto.MetricType_COUNTER, dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+		default:
 			continue
 		}
 
-		metricGroupName, err := getMetricGroupName(mf)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"error": err,
-			})
+		rule, ok := matchGroupRule(groupRules, mf.GetName())
+		if !ok && !generic {
 			continue
 		}
 
 		for _, m := range mf.Metric {
-			groupedKey := getGroupedKey(metricGroupName, m)
+			var metricGroupName, groupedKey string
+			if rule != nil {
+				metricGroupName, groupedKey = rule.group, rule.groupedKey(m)
+			} else {
+				metricGroupName, groupedKey = c.getGenericGroup(m)
+			}
 			metricGroup, ok := metricGroupsMap[groupedKey]
 			if !ok {
 				metricGroup = &MetricGroup{
@@ -66,121 +269,62 @@ func NewMetricGroups(mfs []*dto.MetricFamily) []*MetricGroup {
 				}
 			}
 
-			dp := getDatapointFromMetric(mf, m)
-			if dp == nil {
+			var dps []*DataPoint
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				dps = c.getCounterDatapoints(mf, m, createdTimes, now)
+			case dto.MetricType_HISTOGRAM:
+				dps = c.getHistogramDatapoints(mf, m, createdTimes, now)
+			case dto.MetricType_SUMMARY:
+				dps = c.getSummaryDatapoints(mf, m, createdTimes, now)
+			default:
+				if dp := getGaugeDatapoint(valueRules, mf, m); dp != nil {
+					dps = []*DataPoint{dp}
+				}
+			}
+			if len(dps) == 0 {
 				continue
 			}
+			if rule == nil {
+				metricName := mf.GetName()
+				if name, ok := fieldOf[metricName]; ok {
+					metricName = name
+				}
+				c.foldValueLabels(metricName, m, dps)
+			}
 
-			metricGroup.DataPoints = append(metricGroup.DataPoints, dp)
+			metricGroup.DataPoints = append(metricGroup.DataPoints, dps...)
 
 			metricGroupsMap[groupedKey] = metricGroup
 		}
 
 	}
 
+	// Forget series that have disappeared
+	c.prev, c.next = c.next, nil
+
 	metricGroups := make([]*MetricGroup, 0, len(metricGroupsMap))
 	for k := range metricGroupsMap {
-		metricGroups = append(metricGroups, metricGroupsMap[k])
-	}
-
-	return metricGroups
-}
-
-// We can't use m.GetGauge().GetValue() because there exist some
-// exceptional cases we need to handle. Abstract exception cases
-// in this func
-func getDatapointFromMetric(mf *dto.MetricFamily, m *dto.Metric) *DataPoint {
-	metricLabels := makeLabels(m)
-	metricName := mf.GetName()
-	var metricValue interface{}
-
-	switch metricName {
-	case "kube_pod_status_phase":
-		if m.GetGauge().GetValue() == 1 {
-			metricValue = metricLabels["phase"]
-			delete(metricLabels, "phase")
-		} else {
-			return nil
-		}
-
-	// Only contribute labels
-	case "kube_pod_labels", "kube_pod_info", "kube_service_info", "kube_pod_container_info", "kube_persistentvolumeclaim_info", "kube_cronjob_info", "kube_node_labels", "kube_service_labels", "kube_statefulset_labels":
-		metricValue = nil
-
-	// Formatted as Condition Values (kube-state-metrics v0.5 and prior)
-	case "kube_pod_status_ready", "kube_pod_status_scheduled", "kube_node_status_disk_pressure", "kube_node_status_memory_pressure", "kube_node_status_out_of_disk", "kube_node_status_ready":
-		if m.GetGauge().GetValue() == 1 {
-			metricValue = metricLabels["condition"]
-			delete(metricLabels, "condition")
-		} else {
-			return nil
+		mg := metricGroupsMap[k]
+		if version != "" {
+			mg.DataPoints = append(mg.DataPoints, &DataPoint{Name: "kube_state_metrics_version", Value: version})
 		}
-	// kube-state-metrics v1.0 and up
-	case "kube_node_status_condition":
-		if m.GetGauge().GetValue() == 1 {
-			metricName = fmt.Sprintf("kube_node_status_%s", metricLabels["condition"])
-			metricValue = metricLabels["status"]
-		} else {
-			return nil
-		}
-	case "kube_persistentvolumeclaim_status_phase":
-		if m.GetGauge().GetValue() == 1 {
-			metricValue = metricLabels["phase"]
-			delete(metricLabels, "phase")
-
-		}
-	default:
-		metricValue = m.GetGauge().GetValue()
-	}
-
-	return &DataPoint{
-		Name:   metricName,
-		Value:  metricValue,
-		Labels: metricLabels,
-	}
-}
-
-func validateMetricName(metricName string) bool {
-	match, _ := regexp.MatchString("^kube_[^_]+_*", metricName)
-	if !match {
-		return false
+		metricGroups = append(metricGroups, mg)
 	}
-	return true
-}
-
-// Returns Metric Group based on metric name. kube-state-metrics metric names are formatted kube_<group-name>_*
-func getMetricGroupName(mf *dto.MetricFamily) (string, error) {
-	metricName := mf.GetName()
-
-	if isValid := validateMetricName(metricName); !isValid {
-		return "", errors.New("unable to extract group name from Metric Name")
-	}
-
-	metricNameSplit := strings.Split(metricName, "_")
-
-	if metricNameSplit[1] == "pod" && metricNameSplit[2] == "container" {
-		return "pod-container", nil
+	if !generic {
+		c.joinMetricGroups(metricGroups)
 	}
 
-	return metricNameSplit[1], nil
+	return metricGroups
 }
 
-// Create Key for Grouping Events based on https://github.com/kubernetes/kube-state-metrics/tree/master/Documentation
-func getGroupedKey(metricGroup string, m *dto.Metric) string {
-	labels := makeLabels(m)
-	const SEP = ":"
-	var metricGroupKey string
-
-	switch metricGroup {
-	case "node":
-		metricGroupKey = labels["node"]
-	case "pod-container":
-		metricGroupKey = labels["namespace"] + SEP + labels["pod"] + SEP + labels["container"]
-	default:
-		metricGroupKey = labels["namespace"] + SEP + labels[metricGroup]
-	}
-
-	return metricGroup + SEP + metricGroupKey
+// KubeStateMetricsVersion returns the version of kube-state-metrics detected
+// by the last call to Convert, or "" if the metrics didn't come from
+// kube-state-metrics
+func (c *Converter) KubeStateMetricsVersion() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.kubeStateMetricsVersion
 }
 
 func makeLabels(m *dto.Metric) map[string]string {
@@ -200,6 +344,9 @@ func (mg *MetricGroup) ToEvent() *libhoney.Event {
 		}
 		ev.Add(dp.Labels)
 	}
+	if len(mg.Labels) > 0 {
+		ev.Add(mg.Labels)
+	}
 	ev.AddField("metric_group", mg.MetricGroup)
 	return ev
 }
@@ -231,20 +378,9 @@ func (ls *LibhoneySender) ReadResponses() {
 	}
 }
 
+// ScrapeMetrics scrapes url without any credentials
 func ScrapeMetrics(url string) ([]*dto.MetricFamily, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Accept", acceptHeader)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	return ParseResponse(resp.Header.Get("Content-Type"), resp.Body)
+	return (&ScrapeConfig{}).Scrape(context.Background(), url)
 }
 
 func ParseResponse(contentType string, body io.Reader) ([]*dto.MetricFamily, error) {
@@ -263,6 +399,8 @@ func ParseResponse(contentType string, body io.Reader) ([]*dto.MetricFamily, err
 			}
 			ret = append(ret, mf)
 		}
+	} else if err == nil && mediatype == "application/openmetrics-text" {
+		return ParseOpenMetrics(body)
 	} else {
 		// We could do further content-type checks here, but the
 		// fallback for now will anyway be the text format
@@ -279,17 +417,164 @@ func ParseResponse(contentType string, body io.Reader) ([]*dto.MetricFamily, err
 	return ret, nil
 }
 
-func run(options *Options, sender Sender) {
-	ticker := time.NewTicker(time.Duration(options.Interval) * time.Second)
-	for range ticker.C {
-		metricFamilies, err := ScrapeMetrics(options.URL)
+// genericConverterOptions returns the options for metrics that don't come
+// from kube-state-metrics, such as those pushed by batch jobs. They're
+// grouped by their labels, and only the rules in config apply to them, not
+// the built-in ones for kube-state-metrics.
+func genericConverterOptions(options ConverterOptions, config *Config) ConverterOptions {
+	options.Mode = ModeGeneric
+	options.GroupRules = config.GroupRules
+	options.ValueRules = config.ValueRules
+	options.DisableDefaultValueRules = true
+	return options
+}
+
+// run scrapes and receives metrics until ctx is cancelled, and returns once
+// nothing more will be sent
+func run(ctx context.Context, options *Options, sender Sender) {
+	defaultConfig := options.defaultScrapeConfig()
+	if err := defaultConfig.Init(); err != nil {
+		logrus.WithField("error", err).Fatal("Invalid scrape settings")
+	}
+	urlConfig := defaultConfig
+	if len(options.FederateMatch) > 0 {
+		urlConfig = options.defaultScrapeConfig()
+		urlConfig.Match = options.FederateMatch
+		if err := urlConfig.Init(); err != nil {
+			logrus.WithField("error", err).Fatal("Invalid scrape settings")
+		}
+	}
+	config := &Config{}
+	if options.ConfigFile != "" {
+		var err error
+		if config, err = LoadConfig(options.ConfigFile); err != nil {
+			logrus.WithField("error", err).Fatal("Unable to load config")
+		}
+	}
+
+	untypedCounters, err := CompileMetricPatterns(options.UntypedCounters)
+	if err != nil {
+		logrus.WithField("error", err).Fatal("Invalid --untyped-counter pattern")
+	}
+	groupRules := append([]*GroupRule{}, config.GroupRules...)
+	if options.Mode != ModeGeneric && !config.DisableDefaultGroupRules {
+		groupRules = append(groupRules, DefaultGroupRules...)
+	}
+	converterOptions := ConverterOptions{
+		Mode:                     options.Mode,
+		GroupRules:               groupRules,
+		ValueRules:               config.ValueRules,
+		DisableDefaultValueRules: config.DisableDefaultValueRules,
+		ValueLabels:              options.ValueLabels,
+		EmitCumulative:           options.CounterCumulative,
+		EmitBuckets:              options.HistogramBuckets,
+		EmitSummaryDeltas:        options.SummaryDeltas,
+		UntypedCounters:          untypedCounters,
+		PodLabels:                options.PodLabels,
+		NamespaceLabels:          options.NamespaceLabels,
+	}
+	pool := newScrapePool(time.Duration(options.Interval)*time.Second, sender, converterOptions)
+	discovery := newDiscoveryManager(pool)
+
+	targets := make([]*Target, 0, len(options.URLs))
+	for _, url := range options.URLs {
+		targets = append(targets, &Target{URL: url, Config: urlConfig})
+	}
+	discovery.SetTargets("static", targets)
+
+	refresh := time.Duration(options.RefreshInterval) * time.Second
+	fileRefresh := time.Duration(options.FileSDInterval) * time.Second
+	httpRefresh := time.Duration(options.HTTPSDInterval) * time.Second
+	if options.KubernetesSD {
+		kd, err := NewInClusterKubernetesDiscoverer(options.KubernetesAPIServer, options.KubernetesNamespaces)
 		if err != nil {
-			fmt.Println("Error scraping metrics:", err)
+			logrus.WithField("error", err).Fatal("Unable to set up Kubernetes discovery")
 		}
+		go discovery.Run(ctx, "kubernetes", withScrapeConfig(kd, defaultConfig), refresh)
+	}
+	if len(options.FileSD) > 0 {
+		go discovery.Run(ctx, "file", withScrapeConfig(NewFileDiscoverer(options.FileSD), defaultConfig), fileRefresh)
+	}
+	for _, url := range options.HTTPSD {
+		go discovery.Run(ctx, "http:"+url, withScrapeConfig(NewHTTPDiscoverer(url, httpRefresh), defaultConfig), httpRefresh)
+	}
 
-		metricGroups := NewMetricGroups(metricFamilies)
-		sender.Send(metricGroups)
+	for _, sc := range config.ScrapeConfigs {
+		if sc.ScrapeTimeout == 0 {
+			sc.ScrapeTimeout = defaultConfig.ScrapeTimeout
+		}
+		if sc.RetryBackoff == 0 {
+			sc.RetryBackoff = defaultConfig.RetryBackoff
+		}
+		if len(sc.Queries) > 0 {
+			// Query results are grouped by their labels, whatever they're
+			// called
+			queryOptions := genericConverterOptions(converterOptions, config)
+			sc.converterOptions = &queryOptions
+		}
+		source := "job:" + sc.JobName
+		targets := make([]*Target, 0, len(sc.URLs))
+		for _, url := range sc.URLs {
+			targets = append(targets, &Target{URL: url, Labels: sc.Labels, Config: sc})
+		}
+		discovery.SetTargets(source, targets)
+
+		if len(sc.FileSD) > 0 {
+			go discovery.Run(ctx, source+":file", withScrapeConfig(NewFileDiscoverer(sc.FileSD), sc), fileRefresh)
+		}
+		for _, url := range sc.HTTPSD {
+			go discovery.Run(ctx, source+":http:"+url, withScrapeConfig(NewHTTPDiscoverer(url, httpRefresh), sc), httpRefresh)
+		}
 	}
+
+	// Receivers, which may still be sending once ctx is cancelled. Those
+	// that buffer what they receive send it once more after the server has
+	// stopped, which closes drained.
+	var receivers sync.WaitGroup
+	interval := time.Duration(options.Interval) * time.Second
+	drained := make(chan struct{})
+	if options.receiving() {
+		mux := http.NewServeMux()
+		if options.RemoteWrite {
+			remoteWrite := NewRemoteWriteHandler(NewConverter(converterOptions), sender)
+			mux.Handle("/api/v1/write", remoteWrite)
+			receivers.Add(1)
+			go func() {
+				defer receivers.Done()
+				remoteWrite.Run(ctx, interval, drained)
+			}()
+		}
+		if options.Push {
+			pushOptions := genericConverterOptions(converterOptions, config)
+			push := NewPushHandler(pushOptions, sender, options.PushSend, time.Duration(options.PushRetention)*time.Second)
+			mux.Handle(pushPathPrefix, push)
+			receivers.Add(1)
+			go func() {
+				defer receivers.Done()
+				push.Run(ctx, interval, drained)
+			}()
+		}
+		if options.OTLP {
+			otlp := NewOTLPHandler(genericConverterOptions(converterOptions, config), sender)
+			mux.Handle(otlpHTTPPath, otlp)
+			mux.Handle(otlpGRPCPath, otlp)
+		}
+		auth := &ReceiverAuth{
+			BearerToken: options.ReceiverBearerToken,
+			Username:    options.ReceiverBasicAuthUsername,
+			Password:    options.ReceiverBasicAuthPassword,
+		}
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			defer close(drained)
+			serveReceivers(ctx, options.Listen, newReceiverHandler(auth, options.MaxInflightRequests, mux))
+		}()
+	}
+
+	<-ctx.Done()
+	pool.Stop()
+	receivers.Wait()
 }
 
 func main() {
@@ -306,6 +591,31 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(options.URLs) == 0 && !options.KubernetesSD && len(options.FileSD) == 0 && len(options.HTTPSD) == 0 && options.ConfigFile == "" && !options.receiving() {
+		fmt.Println("Error: at least one of --url, --kubernetes-sd, --file-sd, --http-sd, --config, --remote-write, --push or --otlp is required.")
+		os.Exit(1)
+	}
+
+	if len(options.FederateMatch) > 0 && len(options.URLs) == 0 {
+		fmt.Println("Error: --federate-match only applies to --url targets; use match in --config for others.")
+		os.Exit(1)
+	}
+
+	if options.MaxInflightRequests <= 0 {
+		fmt.Println("Error: --max-inflight-requests must be positive.")
+		os.Exit(1)
+	}
+
+	if options.PushRetention < 0 {
+		fmt.Println("Error: --push-retention can't be negative.")
+		os.Exit(1)
+	}
+
+	if options.Interval <= 0 || options.RefreshInterval <= 0 || options.FileSDInterval <= 0 || options.HTTPSDInterval <= 0 {
+		fmt.Println("Error: --interval and the discovery intervals must be positive.")
+		os.Exit(1)
+	}
+
 	if options.Writekey == "" {
 		options.Writekey = os.Getenv("HONEYCOMB_WRITEKEY")
 	}
@@ -314,11 +624,23 @@ func main() {
 		WriteKey: options.Writekey,
 		Dataset:  options.Dataset,
 		APIHost:  options.APIHost,
+		// Hold up receivers rather than dropping events, so that senders
+		// are told to back off
+		BlockOnSend: options.receiving(),
 	})
 
 	sender := &LibhoneySender{}
 	go sender.ReadResponses()
 
-	run(options, sender)
-
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.WithField("signal", sig).Info("Shutting down")
+		cancel()
+	}()
+
+	run(ctx, options, sender)
+	libhoney.Close()
 }
@@ -9,6 +9,7 @@ import (
 	"os"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -54,7 +55,7 @@ func generateResultFixture(suffix string) {
 
 // Compares generated events from fixtures/metrics.txt with expected result in fixtures/result.txt
 func TestEndToEnd(t *testing.T) {
-	for _, suffix := range []string{"0.5", "1.0"} {
+	for _, suffix := range []string{"0.5", "1.0", "2.0"} {
 		data := readMetrics(suffix)
 		metricFamilies, _ := ParseResponse("text/plain", data)
 		metricGroups := NewMetricGroups(metricFamilies)
@@ -84,14 +85,14 @@ func TestEndToEnd(t *testing.T) {
 	}
 }
 
-func TestMetricNameValidation(t *testing.T) {
-	for _, suffix := range []string{"0.5", "1.0"} {
+func TestDefaultGroupRules(t *testing.T) {
+	for _, suffix := range []string{"0.5", "1.0", "2.0"} {
 		data := readMetrics(suffix)
 		metricFamilies, _ := ParseResponse("text/plain", data)
 		for _, mf := range metricFamilies {
 			name := mf.GetName()
-			if isValid := validateMetricName(name); !isValid {
-				t.Errorf("%s should be a valid metric name", name)
+			if _, ok := matchGroupRule(DefaultGroupRules, name); !ok {
+				t.Errorf("%s should match a default group rule", name)
 			}
 		}
 	}
@@ -105,8 +106,52 @@ func TestMetricNameValidation(t *testing.T) {
 	}
 
 	for _, bn := range badNames {
-		if isValid := validateMetricName(bn); isValid {
-			t.Errorf("%s should not be a valid metric name", bn)
+		if _, ok := matchGroupRule(DefaultGroupRules, bn); ok {
+			t.Errorf("%s should not match a default group rule", bn)
 		}
 	}
+
+	for name, group := range map[string]string{
+		"kube_pod_container_info":         "pod-container",
+		"kube_pod_info":                   "pod",
+		"kube_node_status_condition":      "node",
+		"kube_persistentvolumeclaim_info": "persistentvolumeclaim",
+		"kube_pod":                        "pod",
+	} {
+		match, _ := matchGroupRule(DefaultGroupRules, name)
+		assert.Equal(t, group, match.group, name)
+	}
+}
+
+func TestGenericConverterOptions(t *testing.T) {
+	// Batch jobs may well have kube_ metrics of their own
+	const metrics = `# TYPE kube_job_cleanup_deleted gauge
+kube_job_cleanup_deleted{namespace="ci",job_name="cleanup"} 3
+# TYPE kube_pod_status_phase gauge
+kube_pod_status_phase{namespace="ci",pod="build-1",phase="Running"} 1
+`
+	options := ConverterOptions{Mode: ModeKubeStateMetrics, GroupRules: DefaultGroupRules}
+	groups := convertText(NewConverter(genericConverterOptions(options, &Config{})), metrics, time.Now())
+	names := map[string]bool{}
+	for _, mg := range groups {
+		names[mg.MetricGroup] = true
+	}
+	assert.Equal(t, map[string]bool{"job_name-namespace": true, "namespace-phase-pod": true}, names)
+	assert.Equal(t, 1.0, datapointValues(groups)["kube_pod_status_phase"])
+
+	// Rules from the config still apply
+	config := &Config{
+		GroupRules: []*GroupRule{{Match: "kube_job_.*", Group: "cleanup", Keys: []string{"job_name"}}},
+		ValueRules: []*ValueRule{{Match: "kube_pod_status_phase", Type: ValueRuleLabelValue, Label: "phase"}},
+	}
+	for _, r := range config.GroupRules {
+		mustCompile(r)
+	}
+	for _, r := range config.ValueRules {
+		mustCompile(r)
+	}
+	groups = convertText(NewConverter(genericConverterOptions(options, config)), metrics, time.Now())
+	values := datapointValues(groups)
+	assert.Equal(t, 3.0, values["kube_job_cleanup_deleted"])
+	assert.Equal(t, "Running", values["kube_pod_status_phase"])
 }
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The client_model version we use predates OpenMetrics, so OpenMetrics types
+// are mapped onto the classic ones the same way Prometheus ingests them:
+//
+//   - counters are named <name>_total, and _created series become a
+//     separate <name>_created gauge holding the creation time in seconds
+//   - info metrics become <name>_info gauges and statesets become gauges with
+//     one series per state
+//   - gauge histograms become plain <name>_bucket, <name>_gcount and
+//     <name>_gsum gauges, since their buckets aren't cumulative over time
+//   - unknown metrics are untyped
+//
+// Units are validated against the metric name, and exemplars are parsed but
+// dropped since there is nowhere to put them.
+
+// ParseOpenMetrics reads the OpenMetrics text format
+// (application/openmetrics-text)
+func ParseOpenMetrics(body io.Reader) ([]*dto.MetricFamily, error) {
+	p := &omParser{
+		families: make(map[string]*dto.MetricFamily),
+		metrics:  make(map[string]*dto.Metric),
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if p.eof {
+			return nil, fmt.Errorf("Error reading OpenMetrics line %d: content after # EOF", lineNum)
+		}
+		if err := p.parseLine(scanner.Text()); err != nil {
+			return nil, fmt.Errorf("Error reading OpenMetrics line %d: %v", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !p.eof {
+		return nil, errors.New("Error reading OpenMetrics: missing # EOF")
+	}
+	return p.result, nil
+}
+
+type omParser struct {
+	result   []*dto.MetricFamily
+	families map[string]*dto.MetricFamily
+	metrics  map[string]*dto.Metric
+
+	// The metric family whose samples are being read
+	name string
+	typ  string
+	help string
+	eof  bool
+}
+
+var omTypes = map[string]bool{
+	"counter":        true,
+	"gauge":          true,
+	"histogram":      true,
+	"gaugehistogram": true,
+	"summary":        true,
+	"info":           true,
+	"stateset":       true,
+	"unknown":        true,
+}
+
+// omSuffixes lists the sample name suffixes each type may use
+var omSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"gauge":          {""},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"", "_count", "_sum", "_created"},
+	"info":           {"_info"},
+	"stateset":       {""},
+	"unknown":        {""},
+}
+
+func (p *omParser) parseLine(line string) error {
+	if line == "# EOF" {
+		p.eof = true
+		return nil
+	}
+	if strings.HasPrefix(line, "#") {
+		return p.parseMetadata(line)
+	}
+	if line == "" {
+		return errors.New("empty line")
+	}
+	return p.parseSample(line)
+}
+
+func (p *omParser) parseMetadata(line string) error {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 3 || parts[0] != "#" {
+		return fmt.Errorf("invalid metadata line %q", line)
+	}
+	kind, name := parts[1], parts[2]
+	text := ""
+	if len(parts) == 4 {
+		text = parts[3]
+	}
+
+	if name != p.name {
+		p.startFamily(name)
+	}
+
+	switch kind {
+	case "TYPE":
+		if !omTypes[text] {
+			return fmt.Errorf("unknown metric type %q", text)
+		}
+		p.typ = text
+	case "HELP":
+		p.help = unescapeOM(text)
+	case "UNIT":
+		if text != "" && !strings.HasSuffix(name, "_"+text) {
+			return fmt.Errorf("metric %s must be suffixed with its unit %q", name, text)
+		}
+	default:
+		return fmt.Errorf("unknown metadata %q", kind)
+	}
+	return nil
+}
+
+func (p *omParser) startFamily(name string) {
+	p.name = name
+	p.typ = "unknown"
+	p.help = ""
+}
+
+func (p *omParser) parseSample(line string) error {
+	i := strings.IndexAny(line, "{ ")
+	if i <= 0 {
+		return fmt.Errorf("invalid sample %q", line)
+	}
+	sampleName := line[:i]
+	rest := line[i:]
+
+	var labels []*dto.LabelPair
+	if rest[0] == '{' {
+		var err error
+		if labels, rest, err = parseOMLabels(rest); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return fmt.Errorf("invalid sample %q", line)
+	}
+	rest = rest[1:]
+
+	// Drop the exemplar, if any
+	if i := strings.Index(rest, " # "); i >= 0 {
+		if _, _, err := parseOMLabels(rest[i+3:]); err != nil {
+			return fmt.Errorf("invalid exemplar: %v", err)
+		}
+		rest = rest[:i]
+	}
+
+	fields := strings.Split(rest, " ")
+	if len(fields) > 2 {
+		return fmt.Errorf("invalid sample %q", line)
+	}
+	value, err := parseOMFloat(fields[0])
+	if err != nil {
+		return err
+	}
+	var timestampMs *int64
+	if len(fields) == 2 {
+		ts, err := parseOMFloat(fields[1])
+		if err != nil {
+			return err
+		}
+		timestampMs = proto.Int64(int64(ts * 1000))
+	}
+
+	suffix, ok := p.suffix(sampleName)
+	if !ok {
+		// Samples without metadata belong to their own unknown family
+		p.startFamily(sampleName)
+		suffix = ""
+	}
+	return p.addSample(suffix, labels, value, timestampMs)
+}
+
+func (p *omParser) suffix(sampleName string) (string, bool) {
+	if !strings.HasPrefix(sampleName, p.name) {
+		return "", false
+	}
+	suffix := sampleName[len(p.name):]
+	for _, s := range omSuffixes[p.typ] {
+		if s == suffix {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+func (p *omParser) addSample(suffix string, labels []*dto.LabelPair, value float64, timestampMs *int64) error {
+	if suffix == "_created" {
+		m := p.metric(p.name+"_created", "", dto.MetricType_GAUGE, labels)
+		m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		m.TimestampMs = timestampMs
+		return nil
+	}
+
+	switch p.typ {
+	case "counter":
+		m := p.metric(p.name+"_total", p.help, dto.MetricType_COUNTER, labels)
+		m.Counter = &dto.Counter{Value: proto.Float64(value)}
+		m.TimestampMs = timestampMs
+	case "gauge", "info", "stateset", "gaugehistogram":
+		m := p.metric(p.name+suffix, p.help, dto.MetricType_GAUGE, labels)
+		m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		m.TimestampMs = timestampMs
+	case "unknown":
+		m := p.metric(p.name, p.help, dto.MetricType_UNTYPED, labels)
+		m.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+		m.TimestampMs = timestampMs
+	case "histogram":
+		var le string
+		var err error
+		if suffix == "_bucket" {
+			if le, labels, err = takeLabel(labels, "le"); err != nil {
+				return err
+			}
+		}
+		m := p.metric(p.name, p.help, dto.MetricType_HISTOGRAM, labels)
+		if m.Histogram == nil {
+			m.Histogram = &dto.Histogram{}
+		}
+		m.TimestampMs = timestampMs
+		switch suffix {
+		case "_bucket":
+			bound, err := parseOMFloat(le)
+			if err != nil {
+				return err
+			}
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(bound),
+				CumulativeCount: proto.Uint64(uint64(value)),
+			})
+			if math.IsInf(bound, 1) && m.Histogram.SampleCount == nil {
+				m.Histogram.SampleCount = proto.Uint64(uint64(value))
+			}
+		case "_count":
+			m.Histogram.SampleCount = proto.Uint64(uint64(value))
+		case "_sum":
+			m.Histogram.SampleSum = proto.Float64(value)
+		}
+	case "summary":
+		var quantile string
+		var err error
+		if suffix == "" {
+			if quantile, labels, err = takeLabel(labels, "quantile"); err != nil {
+				return err
+			}
+		}
+		m := p.metric(p.name, p.help, dto.MetricType_SUMMARY, labels)
+		if m.Summary == nil {
+			m.Summary = &dto.Summary{}
+		}
+		m.TimestampMs = timestampMs
+		switch suffix {
+		case "":
+			q, err := parseOMFloat(quantile)
+			if err != nil {
+				return err
+			}
+			m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(q),
+				Value:    proto.Float64(value),
+			})
+		case "_count":
+			m.Summary.SampleCount = proto.Uint64(uint64(value))
+		case "_sum":
+			m.Summary.SampleSum = proto.Float64(value)
+		}
+	}
+	return nil
+}
+
+// metric returns the metric in the named family with the given labels,
+// creating either if needed
+func (p *omParser) metric(name, help string, typ dto.MetricType, labels []*dto.LabelPair) *dto.Metric {
+	mf, ok := p.families[name]
+	if !ok {
+		mf = &dto.MetricFamily{
+			Name: proto.String(name),
+			Type: typ.Enum(),
+		}
+		if help != "" {
+			mf.Help = proto.String(help)
+		}
+		p.families[name] = mf
+		p.result = append(p.result, mf)
+	}
+
+	key := name
+	for _, lp := range labels {
+		key += "\xff" + lp.GetName() + "\xff" + lp.GetValue()
+	}
+	m, ok := p.metrics[key]
+	if !ok {
+		m = &dto.Metric{Label: labels}
+		p.metrics[key] = m
+		mf.Metric = append(mf.Metric, m)
+	}
+	return m
+}
+
+// takeLabel removes the named label, returning its value
+func takeLabel(labels []*dto.LabelPair, name string) (string, []*dto.LabelPair, error) {
+	for i, lp := range labels {
+		if lp.GetName() == name {
+			rest := append(append([]*dto.LabelPair{}, labels[:i]...), labels[i+1:]...)
+			return lp.GetValue(), rest, nil
+		}
+	}
+	return "", nil, fmt.Errorf("missing %q label", name)
+}
+
+// parseOMLabels parses a {name="value",...} label set at the start of s and
+// returns the labels, sorted by name, and the remainder of s
+func parseOMLabels(s string) ([]*dto.LabelPair, string, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, s, fmt.Errorf("expected label set, got %q", s)
+	}
+	s = s[1:]
+
+	var labels []*dto.LabelPair
+	seen := map[string]bool{}
+	for {
+		if strings.HasPrefix(s, "}") {
+			break
+		}
+		eq := strings.Index(s, `="`)
+		if eq <= 0 {
+			return nil, s, fmt.Errorf("invalid label in %q", s)
+		}
+		name := s[:eq]
+		s = s[eq+2:]
+
+		end := -1
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, s, errors.New("unterminated label value")
+		}
+		if seen[name] {
+			return nil, s, fmt.Errorf("duplicate label %q", name)
+		}
+		seen[name] = true
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(unescapeOM(s[:end])),
+		})
+		s = s[end+1:]
+
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, s, fmt.Errorf("expected , or } in %q", s)
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+	return labels, s[1:], nil
+}
+
+func parseOMFloat(s string) (float64, error) {
+	// Go also accepts "inf" and "infinity", OpenMetrics doesn't
+	switch strings.ToLower(s) {
+	case "inf", "infinity", "+infinity", "-infinity":
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// unescapeOM handles the \\, \n and \" escapes
+func unescapeOM(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var result []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch next := s[i+1]; {
+			case next == '\\':
+				result = append(result, '\\')
+				i++
+				continue
+			case next == 'n':
+				result = append(result, '\n')
+				i++
+				continue
+			case next == '"':
+				result = append(result, '"')
+				i++
+				continue
+			}
+		}
+		result = append(result, s[i])
+	}
+	return string(result)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+const openMetricsFixture = `# TYPE kube_pod_container_status_restarts counter
+# HELP kube_pod_container_status_restarts The number of container restarts.
+kube_pod_container_status_restarts_total{container="app",namespace="default",pod="app-1"} 3 # {trace_id="abc123"} 1 1520879607.789
+kube_pod_container_status_restarts_created{container="app",namespace="default",pod="app-1"} 1520872607.123
+# TYPE http_request_duration_seconds histogram
+# UNIT http_request_duration_seconds seconds
+http_request_duration_seconds_bucket{le="0.1",path="/"} 5
+http_request_duration_seconds_bucket{le="1",path="/"} 8 # {trace_id="def"} 0.5
+http_request_duration_seconds_bucket{le="+Inf",path="/"} 10
+http_request_duration_seconds_count{path="/"} 10
+http_request_duration_seconds_sum{path="/"} 4.5
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.5"} 0.001
+go_gc_duration_seconds{quantile="0.99"} 0.01
+go_gc_duration_seconds_count 42
+go_gc_duration_seconds_sum 0.2
+# TYPE build info
+build_info{version="v2.1.0",revision="a\"b\\c"} 1
+# TYPE kube_node_condition stateset
+kube_node_condition{kube_node_condition="ready",node="n1"} 1
+kube_node_condition{kube_node_condition="not_ready",node="n1"} 0
+# TYPE queue_depth gauge
+queue_depth 7 1520879607.5
+legacy_thing NaN
+# EOF
+`
+
+func familiesByName(mfs []*dto.MetricFamily) map[string]*dto.MetricFamily {
+	result := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		result[mf.GetName()] = mf
+	}
+	return result
+}
+
+func TestParseOpenMetrics(t *testing.T) {
+	mfs, err := ParseResponse("application/openmetrics-text; version=1.0.0; charset=utf-8", strings.NewReader(openMetricsFixture))
+	assert.NoError(t, err)
+	families := familiesByName(mfs)
+	assert.Len(t, families, 8)
+
+	restarts := families["kube_pod_container_status_restarts_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, restarts.GetType())
+	assert.Equal(t, "The number of container restarts.", restarts.GetHelp())
+	assert.Equal(t, 3.0, restarts.Metric[0].GetCounter().GetValue())
+	assert.Len(t, restarts.Metric[0].Label, 3)
+	created := families["kube_pod_container_status_restarts_created"]
+	assert.Equal(t, dto.MetricType_GAUGE, created.GetType())
+	assert.Equal(t, 1520872607.123, created.Metric[0].GetGauge().GetValue())
+
+	histogram := families["http_request_duration_seconds"]
+	assert.Equal(t, dto.MetricType_HISTOGRAM, histogram.GetType())
+	assert.Len(t, histogram.Metric, 1)
+	h := histogram.Metric[0].GetHistogram()
+	assert.Equal(t, uint64(10), h.GetSampleCount())
+	assert.Equal(t, 4.5, h.GetSampleSum())
+	assert.Len(t, h.Bucket, 3)
+	assert.True(t, math.IsInf(h.Bucket[2].GetUpperBound(), 1))
+	assert.Equal(t, "path", histogram.Metric[0].Label[0].GetName())
+
+	summary := families["go_gc_duration_seconds"].Metric[0].GetSummary()
+	assert.Equal(t, uint64(42), summary.GetSampleCount())
+	assert.Equal(t, 0.99, summary.Quantile[1].GetQuantile())
+
+	info := families["build_info"]
+	assert.Equal(t, dto.MetricType_GAUGE, info.GetType())
+	assert.Equal(t, `a"b\c`, info.Metric[0].Label[0].GetValue())
+
+	assert.Len(t, families["kube_node_condition"].Metric, 2)
+	assert.Equal(t, int64(1520879607500), families["queue_depth"].Metric[0].GetTimestampMs())
+	assert.Equal(t, dto.MetricType_UNTYPED, families["legacy_thing"].GetType())
+	assert.True(t, math.IsNaN(families["legacy_thing"].Metric[0].GetUntyped().GetValue()))
+}
+
+func TestParseOpenMetricsErrors(t *testing.T) {
+	for _, bad := range []string{
+		"# TYPE foo gauge\nfoo 1\n",
+		"# TYPE foo gauge\nfoo 1\n# EOF\nfoo 2\n",
+		"# TYPE foo_seconds gauge\n# UNIT foo_seconds bytes\nfoo_seconds 1\n# EOF\n",
+		"# TYPE foo histogram\nfoo_bucket 1\n# EOF\n",
+		"# TYPE foo wat\n# EOF\n",
+		"foo{bar=\"baz} 1\n# EOF\n",
+		"foo{a=\"1\",a=\"2\"} 1\n# EOF\n",
+		"foo inf\n# EOF\n",
+	} {
+		_, err := ParseOpenMetrics(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
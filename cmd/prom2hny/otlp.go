@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The messages of OTLP metric exports we use, from
+// https://github.com/open-telemetry/opentelemetry-proto, with the JSON
+// names of OTLP/JSON. Exponential histograms, summaries and exemplars are
+// ignored. Oneofs are fields of their own, which is the same on the wire.
+
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics []*ResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics" json:"resourceMetrics,omitempty"`
+}
+
+func (m *ExportMetricsServiceRequest) Reset()         { *m = ExportMetricsServiceRequest{} }
+func (m *ExportMetricsServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*ExportMetricsServiceRequest) ProtoMessage()    {}
+
+type ExportMetricsServiceResponse struct{}
+
+func (m *ExportMetricsServiceResponse) Reset()         { *m = ExportMetricsServiceResponse{} }
+func (m *ExportMetricsServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*ExportMetricsServiceResponse) ProtoMessage()    {}
+
+type ResourceMetrics struct {
+	Resource     *Resource       `protobuf:"bytes,1,opt,name=resource" json:"resource,omitempty"`
+	ScopeMetrics []*ScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics" json:"scopeMetrics,omitempty"`
+	// Sent instead of ScopeMetrics before OTLP 0.19
+	InstrumentationLibraryMetrics []*ScopeMetrics `protobuf:"bytes,1000,rep,name=instrumentation_library_metrics" json:"instrumentationLibraryMetrics,omitempty"`
+}
+
+func (m *ResourceMetrics) Reset()         { *m = ResourceMetrics{} }
+func (m *ResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*ResourceMetrics) ProtoMessage()    {}
+
+type Resource struct {
+	Attributes []*KeyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+func (m *Resource) Reset()         { *m = Resource{} }
+func (m *Resource) String() string { return proto.CompactTextString(m) }
+func (*Resource) ProtoMessage()    {}
+
+type ScopeMetrics struct {
+	Metrics []*OTLPMetric `protobuf:"bytes,2,rep,name=metrics" json:"metrics,omitempty"`
+}
+
+func (m *ScopeMetrics) Reset()         { *m = ScopeMetrics{} }
+func (m *ScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*ScopeMetrics) ProtoMessage()    {}
+
+type OTLPMetric struct {
+	Name      string         `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Unit      string         `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit,omitempty"`
+	Gauge     *OTLPGauge     `protobuf:"bytes,5,opt,name=gauge" json:"gauge,omitempty"`
+	Sum       *OTLPSum       `protobuf:"bytes,7,opt,name=sum" json:"sum,omitempty"`
+	Histogram *OTLPHistogram `protobuf:"bytes,9,opt,name=histogram" json:"histogram,omitempty"`
+}
+
+func (m *OTLPMetric) Reset()         { *m = OTLPMetric{} }
+func (m *OTLPMetric) String() string { return proto.CompactTextString(m) }
+func (*OTLPMetric) ProtoMessage()    {}
+
+type OTLPGauge struct {
+	DataPoints []*NumberDataPoint `protobuf:"bytes,1,rep,name=data_points" json:"dataPoints,omitempty"`
+}
+
+func (m *OTLPGauge) Reset()         { *m = OTLPGauge{} }
+func (m *OTLPGauge) String() string { return proto.CompactTextString(m) }
+func (*OTLPGauge) ProtoMessage()    {}
+
+func (m *OTLPGauge) GetDataPoints() []*NumberDataPoint {
+	if m == nil {
+		return nil
+	}
+	return m.DataPoints
+}
+
+type OTLPSum struct {
+	DataPoints             []*NumberDataPoint     `protobuf:"bytes,1,rep,name=data_points" json:"dataPoints,omitempty"`
+	AggregationTemporality AggregationTemporality `protobuf:"varint,2,opt,name=aggregation_temporality,proto3" json:"aggregationTemporality,omitempty"`
+	IsMonotonic            bool                   `protobuf:"varint,3,opt,name=is_monotonic,proto3" json:"isMonotonic,omitempty"`
+}
+
+func (m *OTLPSum) Reset()         { *m = OTLPSum{} }
+func (m *OTLPSum) String() string { return proto.CompactTextString(m) }
+func (*OTLPSum) ProtoMessage()    {}
+
+type OTLPHistogram struct {
+	DataPoints             []*HistogramDataPoint  `protobuf:"bytes,1,rep,name=data_points" json:"dataPoints,omitempty"`
+	AggregationTemporality AggregationTemporality `protobuf:"varint,2,opt,name=aggregation_temporality,proto3" json:"aggregationTemporality,omitempty"`
+}
+
+func (m *OTLPHistogram) Reset()         { *m = OTLPHistogram{} }
+func (m *OTLPHistogram) String() string { return proto.CompactTextString(m) }
+func (*OTLPHistogram) ProtoMessage()    {}
+
+type NumberDataPoint struct {
+	Attributes        []*KeyValue  `protobuf:"bytes,7,rep,name=attributes" json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64   `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64   `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3" json:"timeUnixNano,omitempty"`
+	AsDouble          *otlpFloat64 `protobuf:"fixed64,4,opt,name=as_double" json:"asDouble,omitempty"`
+	AsInt             *otlpInt64   `protobuf:"fixed64,6,opt,name=as_int" json:"asInt,omitempty"`
+}
+
+func (m *NumberDataPoint) Reset()         { *m = NumberDataPoint{} }
+func (m *NumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*NumberDataPoint) ProtoMessage()    {}
+
+func (m *NumberDataPoint) value() float64 {
+	if m.AsInt != nil {
+		return float64(*m.AsInt)
+	}
+	if m.AsDouble != nil {
+		return float64(*m.AsDouble)
+	}
+	return 0
+}
+
+type HistogramDataPoint struct {
+	Attributes        []*KeyValue   `protobuf:"bytes,9,rep,name=attributes" json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64    `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64    `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3" json:"timeUnixNano,omitempty"`
+	Count             otlpUint64    `protobuf:"fixed64,4,opt,name=count,proto3" json:"count,omitempty"`
+	Sum               *otlpFloat64  `protobuf:"fixed64,5,opt,name=sum" json:"sum,omitempty"`
+	BucketCounts      []otlpUint64  `protobuf:"fixed64,6,rep,packed,name=bucket_counts" json:"bucketCounts,omitempty"`
+	ExplicitBounds    []otlpFloat64 `protobuf:"fixed64,7,rep,packed,name=explicit_bounds" json:"explicitBounds,omitempty"`
+}
+
+func (m *HistogramDataPoint) Reset()         { *m = HistogramDataPoint{} }
+func (m *HistogramDataPoint) String() string { return proto.CompactTextString(m) }
+func (*HistogramDataPoint) ProtoMessage()    {}
+
+type KeyValue struct {
+	Key   string    `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value *AnyValue `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+}
+
+func (m *KeyValue) Reset()         { *m = KeyValue{} }
+func (m *KeyValue) String() string { return proto.CompactTextString(m) }
+func (*KeyValue) ProtoMessage()    {}
+
+type AnyValue struct {
+	StringValue *string       `protobuf:"bytes,1,opt,name=string_value" json:"stringValue,omitempty"`
+	BoolValue   *bool         `protobuf:"varint,2,opt,name=bool_value" json:"boolValue,omitempty"`
+	IntValue    *otlpInt64    `protobuf:"varint,3,opt,name=int_value" json:"intValue,omitempty"`
+	DoubleValue *otlpFloat64  `protobuf:"fixed64,4,opt,name=double_value" json:"doubleValue,omitempty"`
+	ArrayValue  *ArrayValue   `protobuf:"bytes,5,opt,name=array_value" json:"arrayValue,omitempty"`
+	KvlistValue *KeyValueList `protobuf:"bytes,6,opt,name=kvlist_value" json:"kvlistValue,omitempty"`
+	BytesValue  []byte        `protobuf:"bytes,7,opt,name=bytes_value" json:"bytesValue,omitempty"`
+}
+
+func (m *AnyValue) Reset()         { *m = AnyValue{} }
+func (m *AnyValue) String() string { return proto.CompactTextString(m) }
+func (*AnyValue) ProtoMessage()    {}
+
+type ArrayValue struct {
+	Values []*AnyValue `protobuf:"bytes,1,rep,name=values" json:"values,omitempty"`
+}
+
+func (m *ArrayValue) Reset()         { *m = ArrayValue{} }
+func (m *ArrayValue) String() string { return proto.CompactTextString(m) }
+func (*ArrayValue) ProtoMessage()    {}
+
+type KeyValueList struct {
+	Values []*KeyValue `protobuf:"bytes,1,rep,name=values" json:"values,omitempty"`
+}
+
+func (m *KeyValueList) Reset()         { *m = KeyValueList{} }
+func (m *KeyValueList) String() string { return proto.CompactTextString(m) }
+func (*KeyValueList) ProtoMessage()    {}
+
+// AggregationTemporality says whether a sum or histogram is cumulative or
+// only covers the time since the last export
+type AggregationTemporality int32
+
+const (
+	AggregationTemporalityUnspecified AggregationTemporality = 0
+	AggregationTemporalityDelta       AggregationTemporality = 1
+	AggregationTemporalityCumulative  AggregationTemporality = 2
+)
+
+var aggregationTemporalityNames = map[string]AggregationTemporality{
+	"AGGREGATION_TEMPORALITY_UNSPECIFIED": AggregationTemporalityUnspecified,
+	"AGGREGATION_TEMPORALITY_DELTA":       AggregationTemporalityDelta,
+	"AGGREGATION_TEMPORALITY_CUMULATIVE":  AggregationTemporalityCumulative,
+}
+
+// UnmarshalJSON accepts the name or the number of the enum value
+func (at *AggregationTemporality) UnmarshalJSON(data []byte) error {
+	if value, ok := aggregationTemporalityNames[strings.Trim(string(data), `"`)]; ok {
+		*at = value
+		return nil
+	}
+	n, err := strconv.ParseInt(string(data), 10, 32)
+	*at = AggregationTemporality(n)
+	return err
+}
+
+// otlpInt64 and otlpUint64 are encoded as strings in OTLP/JSON, but numbers
+// are accepted too
+type otlpInt64 int64
+
+func (i *otlpInt64) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*i = otlpInt64(n)
+	return err
+}
+
+type otlpUint64 uint64
+
+func (i *otlpUint64) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	*i = otlpUint64(n)
+	return err
+}
+
+// otlpFloat64 is a number in OTLP/JSON, or one of the strings NaN,
+// Infinity and -Infinity
+type otlpFloat64 float64
+
+func (f *otlpFloat64) UnmarshalJSON(data []byte) error {
+	var value float64
+	var err error
+	switch s := strings.Trim(string(data), `"`); s {
+	case "Infinity":
+		value = math.Inf(1)
+	case "-Infinity":
+		value = math.Inf(-1)
+	default:
+		value, err = strconv.ParseFloat(s, 64)
+	}
+	*f = otlpFloat64(value)
+	return err
+}
+
+// text formats the value as a field, with arrays and key-value lists as
+// JSON
+func (m *AnyValue) text() string {
+	switch {
+	case m == nil:
+		return ""
+	case m.StringValue != nil:
+		return *m.StringValue
+	case m.BoolValue != nil:
+		return strconv.FormatBool(*m.BoolValue)
+	case m.IntValue != nil:
+		return strconv.FormatInt(int64(*m.IntValue), 10)
+	case m.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*m.DoubleValue), 'g', -1, 64)
+	case m.BytesValue != nil:
+		data, _ := json.Marshal(m.BytesValue)
+		return strings.Trim(string(data), `"`)
+	}
+	data, _ := json.Marshal(m.jsonValue())
+	return string(data)
+}
+
+func (m *AnyValue) jsonValue() interface{} {
+	switch {
+	case m == nil:
+		return nil
+	case m.ArrayValue != nil:
+		values := make([]interface{}, 0, len(m.ArrayValue.Values))
+		for _, v := range m.ArrayValue.Values {
+			values = append(values, v.jsonValue())
+		}
+		return values
+	case m.KvlistValue != nil:
+		values := make(map[string]interface{}, len(m.KvlistValue.Values))
+		for _, kv := range m.KvlistValue.Values {
+			values[kv.Key] = kv.Value.jsonValue()
+		}
+		return values
+	}
+	return m.text()
+}
+
+const (
+	otlpHTTPPath = "/v1/metrics"
+	otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	// maxOTLPSize limits the size of a decompressed export
+	maxOTLPSize = 32 << 20
+	// otlpResourceTTL is how long the state of a resource is kept after its
+	// last export
+	otlpResourceTTL = time.Hour
+)
+
+// gRPC status codes
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+)
+
+// Units are spelled out in metric names the way Prometheus exporters of
+// OpenTelemetry metrics do, e.g. http.server.duration in ms becomes
+// http_server_duration_milliseconds
+var (
+	otlpUnits = map[string]string{
+		"d":    "days",
+		"h":    "hours",
+		"min":  "minutes",
+		"s":    "seconds",
+		"ms":   "milliseconds",
+		"us":   "microseconds",
+		"ns":   "nanoseconds",
+		"By":   "bytes",
+		"KiBy": "kibibytes",
+		"MiBy": "mebibytes",
+		"GiBy": "gibibytes",
+		"TiBy": "tibibytes",
+		"KBy":  "kilobytes",
+		"MBy":  "megabytes",
+		"GBy":  "gigabytes",
+		"TBy":  "terabytes",
+		"m":    "meters",
+		"V":    "volts",
+		"A":    "amperes",
+		"J":    "joules",
+		"W":    "watts",
+		"g":    "grams",
+		"Cel":  "celsius",
+		"Hz":   "hertz",
+		"%":    "percent",
+	}
+	otlpPerUnits = map[string]string{
+		"s":  "second",
+		"m":  "minute",
+		"h":  "hour",
+		"d":  "day",
+		"w":  "week",
+		"mo": "month",
+		"y":  "year",
+	}
+	// Annotations such as {requests} aren't units
+	otlpUnitAnnotations = regexp.MustCompile(`\{[^}]*\}`)
+)
+
+// otlpMetricName turns the name and unit of an OpenTelemetry metric into a
+// Prometheus-style name, so the same metric gets the same field whether it
+// was scraped or exported with OTLP
+func otlpMetricName(metric *OTLPMetric, gauge bool) string {
+	name := invalidNameChars.ReplaceAllString(metric.Name, "_")
+	unit := otlpUnitAnnotations.ReplaceAllString(metric.Unit, "")
+
+	var suffix string
+	if unit == "1" {
+		if gauge {
+			suffix = "ratio"
+		}
+	} else if unit != "" {
+		parts := strings.SplitN(unit, "/", 2)
+		suffix = parts[0]
+		if s, ok := otlpUnits[suffix]; ok {
+			suffix = s
+		}
+		if len(parts) == 2 && parts[1] != "" {
+			per := parts[1]
+			if s, ok := otlpPerUnits[per]; ok {
+				per = s
+			}
+			suffix = strings.TrimPrefix(suffix+"_per_"+per, "_")
+		}
+		suffix = strings.Trim(invalidNameChars.ReplaceAllString(suffix, "_"), "_")
+	}
+	if suffix != "" && !strings.HasSuffix(name, "_"+suffix) {
+		name += "_" + suffix
+	}
+	return name
+}
+
+// attributeLabels turns OpenTelemetry attributes into labels, e.g.
+// service.name into service_name
+func attributeLabels(attributes []*KeyValue) map[string]string {
+	labels := make(map[string]string, len(attributes))
+	for _, kv := range attributes {
+		labels[invalidNameChars.ReplaceAllString(kv.Key, "_")] = kv.Value.text()
+	}
+	return labels
+}
+
+// otlpResource is what's kept about each resource metrics are exported
+// from, i.e. each process
+type otlpResource struct {
+	converter *Converter
+	seen      time.Time
+}
+
+// OTLPHandler receives OpenTelemetry metric exports with OTLP/HTTP, as
+// protobuf or JSON, and OTLP/gRPC. Metrics become the same events as
+// Prometheus metrics would, with the attributes of their resource added,
+// and the metrics of each resource kept apart.
+type OTLPHandler struct {
+	converterOptions ConverterOptions
+	sender           Sender
+
+	mtx       sync.Mutex
+	resources map[string]*otlpResource
+}
+
+func NewOTLPHandler(converterOptions ConverterOptions, sender Sender) *OTLPHandler {
+	return &OTLPHandler{
+		converterOptions: converterOptions,
+		sender:           sender,
+		resources:        map[string]*otlpResource{},
+	}
+}
+
+func (oh *OTLPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == otlpGRPCPath {
+		oh.serveGRPC(w, r)
+		return
+	}
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype != "application/x-protobuf" && mediatype != "application/json" {
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOTLPSize))
+	if err == nil && r.Header.Get("Content-Encoding") == "gzip" {
+		data, err = gunzip(data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &ExportMetricsServiceRequest{}
+	if mediatype == "application/json" {
+		err = json.Unmarshal(data, req)
+	} else {
+		err = proto.Unmarshal(data, req)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	oh.export(req, time.Now())
+
+	w.Header().Set("Content-Type", mediatype)
+	if mediatype == "application/json" {
+		w.Write([]byte("{}"))
+	} else {
+		resp, _ := proto.Marshal(&ExportMetricsServiceResponse{})
+		w.Write(resp)
+	}
+}
+
+// serveGRPC handles a call to MetricsService/Export, which is a single
+// length-prefixed message each way, with the status in the trailers
+func (oh *OTLPHandler) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOTLPSize+5))
+	if err != nil || len(data) < 5 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		writeGRPCError(w, grpcInvalidArgument, "expected one length-prefixed message")
+		return
+	}
+	message := data[5:]
+	if data[0] == 1 {
+		if encoding := r.Header.Get("Grpc-Encoding"); encoding != "gzip" {
+			writeGRPCError(w, grpcUnimplemented, fmt.Sprintf("unsupported encoding %q", encoding))
+			return
+		}
+		if message, err = gunzip(message); err != nil {
+			writeGRPCError(w, grpcInvalidArgument, err.Error())
+			return
+		}
+	}
+
+	req := &ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(message, req); err != nil {
+		writeGRPCError(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	oh.export(req, time.Now())
+
+	// An uncompressed, empty ExportMetricsServiceResponse
+	w.Write([]byte{0, 0, 0, 0, 0})
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcOK))
+}
+
+// writeGRPCError fails a call without a response message, so the status
+// goes in the headers instead of the trailers
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	// Percent-encoded, as gRPC requires
+	var escaped bytes.Buffer
+	for _, b := range []byte(message) {
+		if b < ' ' || b > '~' || b == '%' {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		} else {
+			escaped.WriteByte(b)
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", escaped.String())
+	w.WriteHeader(http.StatusOK)
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(gz, maxOTLPSize+1))
+	if err == nil && len(data) > maxOTLPSize {
+		err = fmt.Errorf("decompressed body is larger than %d bytes", maxOTLPSize)
+	}
+	return data, err
+}
+
+// export converts and sends the metrics of each resource in req
+func (oh *OTLPHandler) export(req *ExportMetricsServiceRequest, now time.Time) {
+	var metricGroups []*MetricGroup
+	for _, rm := range req.ResourceMetrics {
+		var labels map[string]string
+		if rm.Resource != nil {
+			labels = attributeLabels(rm.Resource.Attributes)
+		}
+
+		oh.mtx.Lock()
+		key := groupingKey(labels)
+		res, ok := oh.resources[key]
+		if !ok {
+			res = &otlpResource{converter: NewConverter(oh.converterOptions)}
+			oh.resources[key] = res
+		}
+		res.seen = now
+		oh.mtx.Unlock()
+
+		mfs, fieldOf := otlpFamilies(rm)
+
+		for _, mg := range res.converter.convert(mfs, now, fieldOf) {
+			mg.Labels = labels
+			metricGroups = append(metricGroups, mg)
+		}
+	}
+
+	oh.mtx.Lock()
+	for key, res := range oh.resources {
+		if now.Sub(res.seen) > otlpResourceTTL {
+			delete(oh.resources, key)
+		}
+	}
+	oh.mtx.Unlock()
+
+	if len(metricGroups) > 0 {
+		oh.sender.Send(metricGroups)
+	}
+	logrus.WithFields(logrus.Fields{
+		"resources": len(req.ResourceMetrics),
+		"events":    len(metricGroups),
+	}).Debug("Received OTLP metrics")
+}
+
+// otlpFamilies turns the metrics of a resource into metric families. Gauges
+// and non-monotonic sums become gauges, monotonic sums counters, and
+// histograms histograms. The start time of cumulative sums and histograms
+// becomes a _created series, to detect resets. Delta sums and histograms
+// already hold the change since the last export, so they become gauges of
+// the fields the Converter would work out from cumulative ones, e.g.
+// <name>.delta. The metric each of those belongs to is returned by family.
+func otlpFamilies(rm *ResourceMetrics) ([]*dto.MetricFamily, map[string]string) {
+	b := &remoteWriteBuilder{
+		families: map[string]*dto.MetricFamily{},
+		fieldOf:  map[string]string{},
+	}
+	var scopes []*ScopeMetrics
+	scopes = append(scopes, rm.ScopeMetrics...)
+	scopes = append(scopes, rm.InstrumentationLibraryMetrics...)
+	for _, sm := range scopes {
+		for _, metric := range sm.Metrics {
+			addOTLPMetric(b, metric)
+		}
+	}
+
+	result := make([]*dto.MetricFamily, 0, len(b.order))
+	for _, name := range b.order {
+		result = append(result, b.families[name])
+	}
+	return result, b.fieldOf
+}
+
+func otlpDtoMetric(attributes []*KeyValue, timeUnixNano otlpUint64) *dto.Metric {
+	labels := attributeLabels(attributes)
+	m := &dto.Metric{Label: make([]*dto.LabelPair, 0, len(labels))}
+	for k, v := range labels {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+	}
+	sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+	if timeUnixNano != 0 {
+		m.TimestampMs = proto.Int64(int64(timeUnixNano) / int64(time.Millisecond))
+	}
+	return m
+}
+
+func addCreated(b *remoteWriteBuilder, name string, m *dto.Metric, startTimeUnixNano otlpUint64) {
+	if startTimeUnixNano == 0 {
+		return
+	}
+	b.addMetric(createdName(name), dto.MetricType_GAUGE, &dto.Metric{
+		Label: m.Label,
+		Gauge: &dto.Gauge{Value: proto.Float64(float64(startTimeUnixNano) / 1e9)},
+	})
+}
+
+// addDeltaGauge adds a <name>.<field> gauge with the labels and timestamp of
+// m, for one of the fields of a delta point
+func addDeltaGauge(b *remoteWriteBuilder, name, field string, m *dto.Metric, value float64) {
+	b.fieldOf[name+"."+field] = name
+	b.addMetric(name+"."+field, dto.MetricType_GAUGE, &dto.Metric{
+		Label:       m.Label,
+		Gauge:       &dto.Gauge{Value: proto.Float64(value)},
+		TimestampMs: m.TimestampMs,
+	})
+}
+
+// deltaSeconds is how long a delta point covers, or 0 if it's unknown
+func deltaSeconds(startTimeUnixNano, timeUnixNano otlpUint64) float64 {
+	if startTimeUnixNano == 0 || timeUnixNano <= startTimeUnixNano {
+		return 0
+	}
+	return float64(timeUnixNano-startTimeUnixNano) / 1e9
+}
+
+func addOTLPMetric(b *remoteWriteBuilder, metric *OTLPMetric) {
+	switch {
+	case metric.Gauge != nil || (metric.Sum != nil && !metric.Sum.IsMonotonic):
+		dps := metric.Gauge.GetDataPoints()
+		if metric.Sum != nil {
+			if metric.Sum.AggregationTemporality == AggregationTemporalityDelta {
+				// Only changes of values that can go up and down, with
+				// nothing to add them up from
+				logrus.WithField("metric", metric.Name).Debug("Dropping OTLP delta non-monotonic sum")
+				return
+			}
+			dps = metric.Sum.DataPoints
+		}
+		name := otlpMetricName(metric, true)
+		for _, dp := range dps {
+			m := otlpDtoMetric(dp.Attributes, dp.TimeUnixNano)
+			m.Gauge = &dto.Gauge{Value: proto.Float64(dp.value())}
+			b.addMetric(name, dto.MetricType_GAUGE, m)
+		}
+
+	case metric.Sum != nil:
+		name := otlpMetricName(metric, false)
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		for _, dp := range metric.Sum.DataPoints {
+			m := otlpDtoMetric(dp.Attributes, dp.TimeUnixNano)
+			if metric.Sum.AggregationTemporality == AggregationTemporalityDelta {
+				addDeltaGauge(b, name, "delta", m, dp.value())
+				if seconds := deltaSeconds(dp.StartTimeUnixNano, dp.TimeUnixNano); seconds > 0 {
+					addDeltaGauge(b, name, "rate", m, dp.value()/seconds)
+				}
+				continue
+			}
+			m.Counter = &dto.Counter{Value: proto.Float64(dp.value())}
+			addCreated(b, name, m, dp.StartTimeUnixNano)
+			b.addMetric(name, dto.MetricType_COUNTER, m)
+		}
+
+	case metric.Histogram != nil:
+		name := otlpMetricName(metric, false)
+		for _, dp := range metric.Histogram.DataPoints {
+			m := otlpDtoMetric(dp.Attributes, dp.TimeUnixNano)
+			h := &dto.Histogram{SampleCount: proto.Uint64(uint64(dp.Count))}
+			if dp.Sum != nil {
+				h.SampleSum = proto.Float64(float64(*dp.Sum))
+			}
+			// Buckets are counted individually, and the last one has no
+			// upper bound
+			var cumulative uint64
+			for i, bound := range dp.ExplicitBounds {
+				if i < len(dp.BucketCounts) {
+					cumulative += uint64(dp.BucketCounts[i])
+				}
+				h.Bucket = append(h.Bucket, &dto.Bucket{
+					UpperBound:      proto.Float64(float64(bound)),
+					CumulativeCount: proto.Uint64(cumulative),
+				})
+			}
+			if metric.Histogram.AggregationTemporality == AggregationTemporalityDelta {
+				addDeltaGauge(b, name, "count.delta", m, float64(h.GetSampleCount()))
+				addDeltaGauge(b, name, "sum.delta", m, h.GetSampleSum())
+				bounds, counts := histogramBuckets(h)
+				for _, q := range histogramQuantiles {
+					if v, ok := bucketQuantile(q, bounds, counts); ok {
+						addDeltaGauge(b, name, quantileName(q)+".interval", m, v)
+					}
+				}
+				continue
+			}
+			m.Histogram = h
+			addCreated(b, name, m, dp.StartTimeUnixNano)
+			b.addMetric(name, dto.MetricType_HISTOGRAM, m)
+		}
+	}
+}
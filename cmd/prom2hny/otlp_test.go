@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func stringValue(s string) *AnyValue {
+	return &AnyValue{StringValue: proto.String(s)}
+}
+
+func doubleValue(f float64) *otlpFloat64 {
+	v := otlpFloat64(f)
+	return &v
+}
+
+// exportRequest has a gauge, a cumulative counter and a histogram, as of
+// seconds after start
+func exportRequest(start time.Time, seconds int, requests int64, count uint64) *ExportMetricsServiceRequest {
+	now := otlpUint64(start.Add(time.Duration(seconds) * time.Second).UnixNano())
+	attributes := []*KeyValue{{Key: "http.route", Value: stringValue("/users")}}
+	asInt := otlpInt64(requests)
+	return &ExportMetricsServiceRequest{ResourceMetrics: []*ResourceMetrics{{
+		Resource: &Resource{Attributes: []*KeyValue{
+			{Key: "service.name", Value: stringValue("checkout")},
+			{Key: "k8s.pod.name", Value: stringValue("checkout-1")},
+		}},
+		ScopeMetrics: []*ScopeMetrics{{Metrics: []*OTLPMetric{
+			{
+				Name: "process.memory.usage",
+				Unit: "By",
+				Gauge: &OTLPGauge{DataPoints: []*NumberDataPoint{
+					{TimeUnixNano: now, AsDouble: doubleValue(1024)},
+				}},
+			},
+			{
+				Name: "http.server.requests",
+				Unit: "{requests}",
+				Sum: &OTLPSum{
+					AggregationTemporality: AggregationTemporalityCumulative,
+					IsMonotonic:            true,
+					DataPoints: []*NumberDataPoint{
+						{Attributes: attributes, StartTimeUnixNano: otlpUint64(start.UnixNano()), TimeUnixNano: now, AsInt: &asInt},
+					},
+				},
+			},
+			{
+				Name: "http.server.duration",
+				Unit: "ms",
+				Histogram: &OTLPHistogram{
+					AggregationTemporality: AggregationTemporalityCumulative,
+					DataPoints: []*HistogramDataPoint{{
+						Attributes:        attributes,
+						StartTimeUnixNano: otlpUint64(start.UnixNano()),
+						TimeUnixNano:      now,
+						Count:             otlpUint64(count),
+						Sum:               doubleValue(float64(count) * 50),
+						BucketCounts:      []otlpUint64{0, otlpUint64(count), 0},
+						ExplicitBounds:    []otlpFloat64{10, 100},
+					}},
+				},
+			},
+		}}},
+	}}}
+}
+
+func TestOTLPMetricName(t *testing.T) {
+	for _, tc := range []struct {
+		name, unit string
+		gauge      bool
+		expected   string
+	}{
+		{"http.server.duration", "ms", false, "http_server_duration_milliseconds"},
+		{"process.memory.usage", "By", true, "process_memory_usage_bytes"},
+		{"network.io", "By/s", false, "network_io_bytes_per_second"},
+		{"cpu.utilization", "1", true, "cpu_utilization_ratio"},
+		{"http.server.requests", "{requests}", false, "http_server_requests"},
+		{"queue_size_bytes", "By", true, "queue_size_bytes"},
+		{"jvm.classes", "{class}/s", false, "jvm_classes_per_second"},
+	} {
+		assert.Equal(t, tc.expected, otlpMetricName(&OTLPMetric{Name: tc.name, Unit: tc.unit}, tc.gauge), tc.name)
+	}
+}
+
+func TestOTLPHandler(t *testing.T) {
+	sender := &recordingSender{}
+	server := httptest.NewServer(NewOTLPHandler(ConverterOptions{Mode: ModeGeneric}, sender))
+	defer server.Close()
+
+	post := func(contentType string, body []byte) int {
+		resp, err := http.Post(server.URL+otlpHTTPPath, contentType, bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	start := time.Now()
+	data, err := proto.Marshal(exportRequest(start, 10, 5, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, post("application/x-protobuf", data))
+	data, err = proto.Marshal(exportRequest(start, 70, 65, 30))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, post("application/x-protobuf", data))
+
+	for _, mg := range sender.metricGroups {
+		assert.Equal(t, map[string]string{"service_name": "checkout", "k8s_pod_name": "checkout-1"}, mg.Labels)
+	}
+	events := eventFields(sender.metricGroups, "http_route")
+	assert.Equal(t, 1024.0, events["target:"]["process_memory_usage_bytes"])
+	route := events["http_route:/users"]
+	assert.Equal(t, 60.0, route["http_server_requests_total.delta"])
+	assert.Equal(t, 1.0, route["http_server_requests_total.rate"])
+	assert.Equal(t, uint64(20), route["http_server_duration_milliseconds.count.delta"])
+	assert.Equal(t, 1000.0, route["http_server_duration_milliseconds.sum.delta"])
+	assert.Contains(t, route, "http_server_duration_milliseconds.p50.interval")
+	assert.NotContains(t, route, "http_server_requests_total_created")
+
+	// OTLP/JSON, with 64-bit integers as strings and enums by name
+	sender.metricGroups = nil
+	assert.Equal(t, http.StatusOK, post("application/json", []byte(`{"resourceMetrics":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"cart"}}]},
+		"scopeMetrics":[{"metrics":[{
+			"name":"queue.length",
+			"gauge":{"dataPoints":[{"asInt":"7","timeUnixNano":"1700000000000000000","attributes":[{"key":"queue","value":{"stringValue":"orders"}}]}]}
+		},{
+			"name":"jobs.processed",
+			"sum":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_DELTA","isMonotonic":true,"dataPoints":[{"asDouble":3,"attributes":[{"key":"queue","value":{"stringValue":"orders"}}]}]}
+		}]}]
+	}]}`)))
+	if assert.Len(t, sender.metricGroups, 1) {
+		assert.Equal(t, map[string]string{"service_name": "cart"}, sender.metricGroups[0].Labels)
+		assert.Equal(t, map[string]interface{}{"queue_length": 7.0, "jobs_processed_total.delta": 3.0}, datapointValues(sender.metricGroups))
+	}
+
+	assert.Equal(t, http.StatusBadRequest, post("application/json", []byte("{")))
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("text/plain", nil))
+}
+
+func TestOTLPDeltaTemporality(t *testing.T) {
+	sender := &recordingSender{}
+	handler := NewOTLPHandler(ConverterOptions{Mode: ModeGeneric, ValueLabels: []string{"state"}}, sender)
+	start := time.Now()
+	for i, delta := range []float64{3, 4} {
+		from := otlpUint64(start.Add(time.Duration(i) * time.Minute).UnixNano())
+		to := otlpUint64(start.Add(time.Duration(i+1) * time.Minute).UnixNano())
+		sender.metricGroups = nil
+		handler.export(&ExportMetricsServiceRequest{ResourceMetrics: []*ResourceMetrics{{
+			ScopeMetrics: []*ScopeMetrics{{Metrics: []*OTLPMetric{{
+				Name: "jobs.processed",
+				Sum: &OTLPSum{
+					AggregationTemporality: AggregationTemporalityDelta,
+					IsMonotonic:            true,
+					DataPoints: []*NumberDataPoint{{
+						Attributes:        []*KeyValue{{Key: "state", Value: stringValue("done")}},
+						StartTimeUnixNano: from,
+						TimeUnixNano:      to,
+						AsDouble:          doubleValue(delta),
+					}},
+				},
+			}, {
+				Name: "job.duration",
+				Unit: "s",
+				Histogram: &OTLPHistogram{
+					AggregationTemporality: AggregationTemporalityDelta,
+					DataPoints: []*HistogramDataPoint{{
+						StartTimeUnixNano: from,
+						TimeUnixNano:      to,
+						Count:             otlpUint64(delta),
+						Sum:               doubleValue(delta * 2),
+						BucketCounts:      []otlpUint64{0, otlpUint64(delta)},
+						ExplicitBounds:    []otlpFloat64{1},
+					}},
+				},
+			}}}},
+		}}}, start.Add(time.Duration(i+1)*time.Minute))
+
+		// Every export counts, including the first
+		values := datapointValues(sender.metricGroups)
+		assert.Equal(t, delta, values["jobs_processed_total.done.delta"])
+		assert.Equal(t, delta/60, values["jobs_processed_total.done.rate"])
+		assert.Equal(t, delta, values["job_duration_seconds.count.delta"])
+		assert.Equal(t, delta*2, values["job_duration_seconds.sum.delta"])
+		assert.Contains(t, values, "job_duration_seconds.p50.interval")
+	}
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	sender := &recordingSender{}
+	handler := NewOTLPHandler(ConverterOptions{Mode: ModeGeneric}, sender)
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+
+	// HTTP/2 without TLS, as gRPC clients connect with insecure credentials
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	call := func(message []byte) (*http.Response, []byte) {
+		frame := make([]byte, 5, 5+len(message))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+		req, _ := http.NewRequest("POST", server.URL+otlpGRPCPath, bytes.NewReader(append(frame, message...)))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, body
+	}
+
+	data, err := proto.Marshal(exportRequest(time.Now(), 10, 5, 10))
+	assert.NoError(t, err)
+	resp, body := call(data)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+	assert.Equal(t, []byte{0, 0, 0, 0, 0}, body)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, 1024.0, datapointValues(sender.metricGroups)["process_memory_usage_bytes"])
+
+	resp, _ = call([]byte("\xff\xff"))
+	assert.Equal(t, "3", resp.Header.Get("Grpc-Status"))
+	assert.NotEmpty(t, resp.Header.Get("Grpc-Message"))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const pushPathPrefix = "/metrics/"
+
+// When pushed metrics are sent
+const (
+	// PushSendImmediate sends pushed metrics as soon as they arrive
+	PushSendImmediate = "immediate"
+	// PushSendInterval sends the metrics of every group on each interval,
+	// until they're deleted or expire
+	PushSendInterval = "interval"
+)
+
+// pushGroup is the metrics pushed under one grouping key
+type pushGroup struct {
+	labels    map[string]string
+	families  map[string]*dto.MetricFamily
+	converter *pushConverter
+	pushed    time.Time
+}
+
+// pushConverter converts the metrics of a group, keeping the state of
+// cumulative series when the group is replaced. Concurrent pushes to a
+// group are converted one at a time, and any that reach it after a later
+// one are dropped, since the later one already includes their metrics.
+type pushConverter struct {
+	mtx       sync.Mutex
+	converter *Converter
+	// When the metrics last converted were pushed
+	converted time.Time
+}
+
+// PushHandler accepts metrics pushed by batch jobs the way the Prometheus
+// Pushgateway does, under a grouping key made of the job and any other
+// labels in the path, e.g. /metrics/job/backup/instance/db-1. PUT replaces
+// all metrics of the group, POST only those with the same names, and
+// DELETE removes the group.
+type PushHandler struct {
+	converterOptions ConverterOptions
+	sender           Sender
+	send             string
+	// Groups not pushed to for this long are forgotten, unless it's 0
+	retention time.Duration
+
+	mtx    sync.Mutex
+	groups map[string]*pushGroup
+}
+
+func NewPushHandler(converterOptions ConverterOptions, sender Sender, send string, retention time.Duration) *PushHandler {
+	return &PushHandler{
+		converterOptions: converterOptions,
+		sender:           sender,
+		send:             send,
+		retention:        retention,
+		groups:           map[string]*pushGroup{},
+	}
+}
+
+// parseGroupingKey reads the labels from a path such as
+// /metrics/job/backup/instance/db-1. Values of labels whose name ends in
+// @base64 are URL-safe base64, so they can contain slashes.
+func parseGroupingKey(path string) (map[string]string, error) {
+	if !strings.HasPrefix(path, pushPathPrefix) {
+		return nil, errors.New("path must start with " + pushPathPrefix)
+	}
+	parts := strings.Split(strings.TrimPrefix(path, pushPathPrefix), "/")
+	if parts[0] != "job" && parts[0] != "job@base64" {
+		return nil, errors.New("grouping key must start with the job")
+	}
+	if len(parts)%2 != 0 {
+		return nil, errors.New("grouping key labels must come in name/value pairs")
+	}
+
+	labels := make(map[string]string, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for %s: %v", name, err)
+			}
+			value = string(decoded)
+		}
+		if name == "" || invalidNameChars.MatchString(name) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if name == "job" && value == "" {
+			return nil, errors.New("job can't be empty")
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+func groupingKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"\xfe"+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+func (ph *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	labels, err := parseGroupingKey(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := groupingKey(labels)
+
+	var mfs []*dto.MetricFamily
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		mfs, err = ParseResponse(r.Header.Get("Content-Type"), r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		ph.mtx.Lock()
+		delete(ph.groups, key)
+		ph.mtx.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ph.mtx.Lock()
+	group, ok := ph.groups[key]
+	if !ok || r.Method == http.MethodPut {
+		group = &pushGroup{
+			labels:   labels,
+			families: map[string]*dto.MetricFamily{},
+		}
+		if ok {
+			// Keep the state of cumulative series
+			group.converter = ph.groups[key].converter
+		} else {
+			group.converter = &pushConverter{converter: NewConverter(ph.converterOptions)}
+		}
+		ph.groups[key] = group
+	}
+	for _, mf := range mfs {
+		group.families[mf.GetName()] = mf
+	}
+	now := time.Now()
+	group.pushed = now
+	ph.mtx.Unlock()
+
+	if ph.send == PushSendImmediate {
+		ph.sendGroups([]*pushGroup{group}, now)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// sendGroups converts and sends the metrics of groups
+func (ph *PushHandler) sendGroups(groups []*pushGroup, now time.Time) {
+	var metricGroups []*MetricGroup
+	for _, group := range groups {
+		pc := group.converter
+		pc.mtx.Lock()
+		if now.Before(pc.converted) {
+			pc.mtx.Unlock()
+			continue
+		}
+		pc.converted = now
+
+		ph.mtx.Lock()
+		mfs := make([]*dto.MetricFamily, 0, len(group.families))
+		for _, mf := range group.families {
+			mfs = append(mfs, mf)
+		}
+		ph.mtx.Unlock()
+
+		for _, mg := range pc.converter.Convert(mfs, now) {
+			mg.Labels = group.labels
+			metricGroups = append(metricGroups, mg)
+		}
+		pc.mtx.Unlock()
+	}
+	if len(metricGroups) > 0 {
+		ph.sender.Send(metricGroups)
+	}
+}
+
+// expire forgets groups that weren't pushed to within the retention, and
+// returns the others
+func (ph *PushHandler) expire(now time.Time) []*pushGroup {
+	ph.mtx.Lock()
+	defer ph.mtx.Unlock()
+	groups := make([]*pushGroup, 0, len(ph.groups))
+	for key, group := range ph.groups {
+		if ph.retention > 0 && now.Sub(group.pushed) > ph.retention {
+			logrus.WithField("labels", group.labels).Info("Pushed metrics expired")
+			delete(ph.groups, key)
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Run expires groups every interval, and with PushSendInterval sends the
+// rest, until ctx is cancelled. With PushSendInterval it then sends them
+// once more after drained is closed, when the requests in flight have been
+// handled and no more will be accepted.
+func (ph *PushHandler) Run(ctx context.Context, interval time.Duration, drained <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if ph.send == PushSendInterval {
+				<-drained
+				now := time.Now()
+				ph.sendGroups(ph.expire(now), now)
+			}
+			return
+		case now := <-ticker.C:
+			groups := ph.expire(now)
+			if ph.send == PushSendInterval {
+				ph.sendGroups(groups, now)
+			}
+		}
+	}
+}
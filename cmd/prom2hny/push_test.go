@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGroupingKey(t *testing.T) {
+	labels, err := parseGroupingKey("/metrics/job/backup/instance/db-1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"job": "backup", "instance": "db-1"}, labels)
+
+	// base64 values may contain slashes, with or without padding
+	labels, err = parseGroupingKey("/metrics/job/backup/path@base64/L3Zhci9kYXRh")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"job": "backup", "path": "/var/data"}, labels)
+	labels, err = parseGroupingKey("/metrics/job@base64/Y2kvYnVpbGQ=")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"job": "ci/build"}, labels)
+
+	for _, path := range []string{
+		"/metrics/job/",
+		"/metrics/job/backup/instance",
+		"/metrics/job/backup/in-stance/x",
+		"/metrics/job/backup/path@base64/!!",
+		"/metrics/other",
+	} {
+		_, err := parseGroupingKey(path)
+		assert.Error(t, err, path)
+	}
+
+	assert.Equal(t,
+		groupingKey(map[string]string{"job": "a", "instance": "b"}),
+		groupingKey(map[string]string{"instance": "b", "job": "a"}))
+	assert.NotEqual(t,
+		groupingKey(map[string]string{"job": "a", "instance": "b"}),
+		groupingKey(map[string]string{"job": "a", "instance": "c"}))
+}
+
+func TestPushHandler(t *testing.T) {
+	sender := &recordingSender{}
+	handler := NewPushHandler(ConverterOptions{Mode: ModeGeneric}, sender, PushSendImmediate, 0)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	push := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, push("PUT", "/metrics/job/backup/instance/db-1", `
+# TYPE backup_duration_seconds gauge
+backup_duration_seconds 42
+# TYPE backup_size_bytes gauge
+backup_size_bytes 1024
+`))
+	if assert.Len(t, sender.metricGroups, 1) {
+		assert.Equal(t, map[string]string{"job": "backup", "instance": "db-1"}, sender.metricGroups[0].Labels)
+		assert.Equal(t, map[string]interface{}{"backup_duration_seconds": 42.0, "backup_size_bytes": 1024.0}, datapointValues(sender.metricGroups))
+	}
+
+	// POST only replaces metrics with the same name
+	sender.metricGroups = nil
+	assert.Equal(t, http.StatusOK, push("POST", "/metrics/job/backup/instance/db-1", "# TYPE backup_duration_seconds gauge\nbackup_duration_seconds 50\n"))
+	assert.Equal(t, map[string]interface{}{"backup_duration_seconds": 50.0, "backup_size_bytes": 1024.0}, datapointValues(sender.metricGroups))
+
+	// PUT replaces all of them
+	sender.metricGroups = nil
+	assert.Equal(t, http.StatusOK, push("PUT", "/metrics/job/backup/instance/db-1", "# TYPE backup_duration_seconds gauge\nbackup_duration_seconds 60\n"))
+	assert.Equal(t, map[string]interface{}{"backup_duration_seconds": 60.0}, datapointValues(sender.metricGroups))
+
+	assert.Equal(t, http.StatusOK, push("PUT", "/metrics/job/backup/instance/db-2", "# TYPE backup_duration_seconds gauge\nbackup_duration_seconds 70\n"))
+	assert.Len(t, handler.groups, 2)
+	assert.Equal(t, http.StatusAccepted, push("DELETE", "/metrics/job/backup/instance/db-2", ""))
+	assert.Len(t, handler.groups, 1)
+
+	assert.Equal(t, http.StatusBadRequest, push("PUT", "/metrics/job/backup/instance", "# TYPE backup_duration_seconds gauge\nbackup_duration_seconds 1\n"))
+	assert.Equal(t, http.StatusBadRequest, push("PUT", "/metrics/job/backup", "not metrics {"))
+	assert.Equal(t, http.StatusMethodNotAllowed, push("GET", "/metrics/job/backup", ""))
+}
+
+func TestPushHandlerInterval(t *testing.T) {
+	sender := &recordingSender{}
+	handler := NewPushHandler(ConverterOptions{Mode: ModeGeneric}, sender, PushSendInterval, time.Minute)
+	req := httptest.NewRequest("PUT", "/metrics/job/backup", strings.NewReader("# TYPE backup_size_bytes gauge\nbackup_size_bytes 1024\n"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// Not sent until the next interval
+	assert.Empty(t, sender.metricGroups)
+
+	pushed := handler.groups[groupingKey(map[string]string{"job": "backup"})].pushed
+	for i := 0; i < 2; i++ {
+		handler.sendGroups(handler.expire(pushed.Add(30*time.Second)), pushed.Add(30*time.Second))
+	}
+	// Sent on every interval until the group expires
+	assert.Len(t, sender.metricGroups, 2)
+
+	assert.Empty(t, handler.expire(pushed.Add(2*time.Minute)))
+	assert.Empty(t, handler.groups)
+}
+
+func TestPushHandlerConcurrent(t *testing.T) {
+	const concurrentPush = `# TYPE backup_files_total counter
+backup_files_total 10
+# TYPE backup_size_bytes gauge
+backup_size_bytes 1024
+`
+	sender := &recordingSender{}
+	handler := NewPushHandler(ConverterOptions{Mode: ModeGeneric}, sender, PushSendImmediate, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			method := "POST"
+			if i%2 == 0 {
+				method = "PUT"
+			}
+			req := httptest.NewRequest(method, "/metrics/job/backup", strings.NewReader(concurrentPush))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}(i)
+	}
+	wg.Wait()
+	assert.NotEmpty(t, sender.metricGroups)
+	for _, mg := range sender.metricGroups {
+		values := datapointValues([]*MetricGroup{mg})
+		assert.Equal(t, 1024.0, values["backup_size_bytes"])
+		if delta, ok := values["backup_files_total.delta"]; ok {
+			assert.Equal(t, 0.0, delta)
+		}
+	}
+
+	// Metrics that reach the converter after later ones are dropped
+	sender.metricGroups = nil
+	group := handler.groups[groupingKey(map[string]string{"job": "backup"})]
+	handler.sendGroups([]*pushGroup{group}, group.pushed.Add(-time.Second))
+	assert.Empty(t, sender.metricGroups)
+	handler.sendGroups([]*pushGroup{group}, group.pushed.Add(time.Second))
+	assert.Len(t, sender.metricGroups, 1)
+}
+
+func TestPushHandlerRun(t *testing.T) {
+	sender := &recordingSender{}
+	handler := NewPushHandler(ConverterOptions{Mode: ModeGeneric}, sender, PushSendInterval, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.Run(ctx, time.Hour, drained)
+	}()
+	cancel()
+
+	// Pushes still in flight once ctx is cancelled are sent too
+	req := httptest.NewRequest("PUT", "/metrics/job/backup", strings.NewReader("# TYPE backup_size_bytes gauge\nbackup_size_bytes 1024\n"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	close(drained)
+	<-done
+	assert.Equal(t, map[string]interface{}{"backup_size_bytes": 1024.0}, datapointValues(sender.metricGroups))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Query is a PromQL instant query, e.g. for the output of a recording rule.
+// Each series in its result becomes a gauge called Name, or keeps its own
+// name if Name is empty. Series without either are dropped.
+type Query struct {
+	Name  string `yaml:"name"`
+	Query string `yaml:"query"`
+}
+
+// queryResponse is the body of /api/v1/query responses
+type queryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// querySample is a series of an instant vector. Value is the timestamp in
+// seconds and the value as a string.
+type querySample struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+}
+
+func (qs *querySample) parse() (float64, int64, error) {
+	if len(qs.Value) != 2 {
+		return 0, 0, fmt.Errorf("unexpected sample %v", qs.Value)
+	}
+	timestamp, ok := qs.Value[0].(float64)
+	s, isString := qs.Value[1].(string)
+	if !ok || !isString {
+		return 0, 0, fmt.Errorf("unexpected sample %v", qs.Value)
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	return value, int64(timestamp * 1000), err
+}
+
+// query runs the config's queries against the Prometheus HTTP API at
+// baseURL, all at the same evaluation time, and returns their results as
+// gauge families
+func (sc *ScrapeConfig) query(ctx context.Context, baseURL string, timeout time.Duration) ([]*dto.MetricFamily, error) {
+	evalTime := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Millisecond))/1000, 'f', -1, 64)
+	families := map[string]*dto.MetricFamily{}
+	var result []*dto.MetricFamily
+	for _, q := range sc.Queries {
+		samples, err := sc.runQuery(ctx, baseURL, q.Query, evalTime, timeout)
+		if err != nil {
+			return nil, queryError(q.Query, err)
+		}
+		for _, qs := range samples {
+			value, timestamp, err := qs.parse()
+			if err != nil {
+				return nil, queryError(q.Query, err)
+			}
+			name := q.Name
+			if name == "" {
+				name = qs.Metric["__name__"]
+			}
+			if name == "" {
+				continue
+			}
+
+			labels := make([]*dto.LabelPair, 0, len(qs.Metric))
+			for k, v := range qs.Metric {
+				if k != "__name__" {
+					labels = append(labels, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+			mf, ok := families[name]
+			if !ok {
+				mf = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum()}
+				families[name] = mf
+				result = append(result, mf)
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:       labels,
+				Gauge:       &dto.Gauge{Value: proto.Float64(value)},
+				TimestampMs: proto.Int64(timestamp),
+			})
+		}
+	}
+	return result, nil
+}
+
+// queryError says which query failed, and keeps err retryable if it was
+func queryError(query string, err error) error {
+	if re, ok := err.(*retryableError); ok {
+		return &retryableError{err: queryError(query, re.err), retryAfter: re.retryAfter}
+	}
+	return fmt.Errorf("query %q failed: %v", query, err)
+}
+
+// runQuery evaluates query at evalTime. Scalar results are returned as a
+// series without labels.
+func (sc *ScrapeConfig) runQuery(ctx context.Context, baseURL, query, evalTime string, timeout time.Duration) ([]*querySample, error) {
+	form := url.Values{"query": {query}, "time": {evalTime}}
+	if timeout > 0 {
+		form.Set("timeout", timeout.String())
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(baseURL, "/")+"/api/v1/query", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := sc.do(ctx, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	qr := &queryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(qr); err != nil {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	if qr.Status != "success" {
+		return nil, fmt.Errorf("%s: %s", qr.ErrorType, qr.Error)
+	}
+
+	switch qr.Data.ResultType {
+	case "vector":
+		var samples []*querySample
+		err := json.Unmarshal(qr.Data.Result, &samples)
+		return samples, err
+	case "scalar":
+		qs := &querySample{}
+		err := json.Unmarshal(qr.Data.Result, &qs.Value)
+		return []*querySample{qs}, err
+	default:
+		return nil, fmt.Errorf("unsupported result type %q", qr.Data.ResultType)
+	}
+}
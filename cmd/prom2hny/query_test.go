@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// queryStub serves /api/v1/query with the JSON result of each query
+func queryStub(t *testing.T, results map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/query", r.URL.Path)
+		assert.NotEmpty(t, r.FormValue("time"))
+		result, ok := results[r.FormValue("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"success","data":`+result+`}`)
+	}))
+}
+
+func TestQuery(t *testing.T) {
+	server := queryStub(t, map[string]string{
+		`sum by (namespace) (rate(container_cpu_usage_seconds_total[5m]))`: `{"resultType":"vector","result":[
+			{"metric":{"namespace":"default"},"value":[1700000000.5,"0.25"]},
+			{"metric":{"namespace":"monitoring"},"value":[1700000000.5,"1.5"]}]}`,
+		`{__name__=~"namespace:memory_bytes:sum"}`: `{"resultType":"vector","result":[
+			{"metric":{"__name__":"namespace:memory_bytes:sum","namespace":"default"},"value":[1700000000.5,"1024"]}]}`,
+		`scalar(count(kube_node_info))`: `{"resultType":"scalar","result":[1700000000.5,"3"]}`,
+	})
+	defer server.Close()
+
+	sc := &ScrapeConfig{Queries: []*Query{
+		{Name: "namespace_cpu_usage", Query: `sum by (namespace) (rate(container_cpu_usage_seconds_total[5m]))`},
+		{Query: `{__name__=~"namespace:memory_bytes:sum"}`},
+		{Name: "nodes", Query: `scalar(count(kube_node_info))`},
+	}}
+	assert.NoError(t, sc.Init())
+	mfs, err := sc.Scrape(context.Background(), server.URL+"/")
+	assert.NoError(t, err)
+	families := familiesByName(mfs)
+	assert.Len(t, families, 3)
+	cpu := families["namespace_cpu_usage"]
+	if assert.Len(t, cpu.Metric, 2) {
+		assert.Equal(t, dto.MetricType_GAUGE, cpu.GetType())
+		assert.Equal(t, map[string]string{"namespace": "default"}, makeLabels(cpu.Metric[0]))
+		assert.Equal(t, 0.25, cpu.Metric[0].GetGauge().GetValue())
+		assert.Equal(t, int64(1700000000500), cpu.Metric[0].GetTimestampMs())
+	}
+	assert.Equal(t, map[string]string{"namespace": "default"}, makeLabels(families["namespace:memory_bytes:sum"].Metric[0]))
+	assert.Equal(t, 3.0, families["nodes"].Metric[0].GetGauge().GetValue())
+
+	// Each result is an event grouped by its labels
+	c := NewConverter(ConverterOptions{Mode: ModeGeneric})
+	events := eventFields(c.Convert(mfs, time.Now()), "namespace")
+	assert.Equal(t, 0.25, events["namespace:default"]["namespace_cpu_usage"])
+	assert.Equal(t, 1024.0, events["namespace:default"]["namespace:memory_bytes:sum"])
+	assert.Equal(t, 1.5, events["namespace:monitoring"]["namespace_cpu_usage"])
+
+	sc.Queries = append(sc.Queries, &Query{Name: "bad", Query: "sum("})
+	_, err = sc.Scrape(context.Background(), server.URL)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "parse error")
+	}
+}
+
+func TestQueryRetry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"3"]}}`)
+	}))
+	defer server.Close()
+
+	sc := &ScrapeConfig{
+		Queries:      []*Query{{Name: "nodes", Query: "scalar(count(kube_node_info))"}},
+		Retries:      1,
+		RetryBackoff: time.Millisecond,
+	}
+	assert.NoError(t, sc.Init())
+	mfs, err := sc.Scrape(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 3.0, familiesByName(mfs)["nodes"].Metric[0].GetGauge().GetValue())
+
+	// Still says which query failed once out of retries
+	sc.Retries = 0
+	attempts = 0
+	_, err = sc.Scrape(context.Background(), server.URL)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "scalar(count(kube_node_info))")
+		assert.Contains(t, err.Error(), "503")
+	}
+}
+
+func TestQueryConfig(t *testing.T) {
+	assert.Error(t, (&ScrapeConfig{Queries: []*Query{{Name: "x"}}}).Init())
+	assert.Error(t, (&ScrapeConfig{Match: []string{"up"}, Queries: []*Query{{Query: "up"}}}).Init())
+}
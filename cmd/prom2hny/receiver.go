@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ReceiverAuth is what callers pushing metrics to prom2hny must send,
+// either a bearer token or a username and password. If all are empty, no
+// credentials are needed.
+type ReceiverAuth struct {
+	BearerToken string
+	Username    string
+	Password    string
+}
+
+func (ra *ReceiverAuth) check(r *http.Request) bool {
+	equal := func(a, b string) bool {
+		return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+	}
+	if ra.BearerToken != "" {
+		return equal(r.Header.Get("Authorization"), "Bearer "+ra.BearerToken)
+	}
+	if ra.Username != "" || ra.Password != "" {
+		username, password, ok := r.BasicAuth()
+		// Check both to take the same time either way
+		usernameOK := equal(username, ra.Username)
+		passwordOK := equal(password, ra.Password)
+		return ok && usernameOK && passwordOK
+	}
+	return true
+}
+
+// receiverHandler authenticates requests, and rejects them with 503 while
+// maxInflight requests are already being handled. Senders such as
+// Prometheus retry those later, which pushes back on them when events
+// can't be sent to Honeycomb as fast as they arrive.
+type receiverHandler struct {
+	auth     *ReceiverAuth
+	inflight chan struct{}
+	handler  http.Handler
+}
+
+func newReceiverHandler(auth *ReceiverAuth, maxInflight int, handler http.Handler) *receiverHandler {
+	return &receiverHandler{
+		auth:     auth,
+		inflight: make(chan struct{}, maxInflight),
+		handler:  handler,
+	}
+}
+
+func (rh *receiverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !rh.auth.check(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="prom2hny"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	select {
+	case rh.inflight <- struct{}{}:
+		defer func() { <-rh.inflight }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests in flight", http.StatusServiceUnavailable)
+		return
+	}
+	rh.handler.ServeHTTP(w, r)
+}
+
+// serveReceivers listens on addr until ctx is cancelled, and returns once
+// the requests in flight have been handled. Requests may use HTTP/2 without
+// TLS, as gRPC clients do.
+func serveReceivers(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: h2c.NewHandler(handler, &http2.Server{})}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logrus.WithField("address", addr).Info("Listening for pushed metrics")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logrus.WithField("error", err).Fatal("Unable to listen for pushed metrics")
+	}
+	<-shutdown
+}
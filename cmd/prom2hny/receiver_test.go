@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiverBasicAuth(t *testing.T) {
+	auth := &ReceiverAuth{Username: "prometheus", Password: "hunter2"}
+	req, _ := http.NewRequest("POST", "/", nil)
+	assert.False(t, auth.check(req))
+	req.SetBasicAuth("prometheus", "wrong")
+	assert.False(t, auth.check(req))
+	req.SetBasicAuth("prometheus", "hunter2")
+	assert.True(t, auth.check(req))
+	assert.True(t, (&ReceiverAuth{}).check(&http.Request{Header: http.Header{}}))
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The messages of the Prometheus remote write protocol we use, from
+// https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto and
+// types.proto. Exemplars and native histograms are ignored.
+
+type WriteRequest struct {
+	Timeseries []*TimeSeries     `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+	Metadata   []*MetricMetadata `protobuf:"bytes,3,rep,name=metadata" json:"metadata,omitempty"`
+}
+
+func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
+func (m *WriteRequest) String() string { return proto.CompactTextString(m) }
+func (*WriteRequest) ProtoMessage()    {}
+
+type TimeSeries struct {
+	Labels  []*Label  `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Samples []*Sample `protobuf:"bytes,2,rep,name=samples" json:"samples,omitempty"`
+}
+
+func (m *TimeSeries) Reset()         { *m = TimeSeries{} }
+func (m *TimeSeries) String() string { return proto.CompactTextString(m) }
+func (*TimeSeries) ProtoMessage()    {}
+
+type Label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *Label) Reset()         { *m = Label{} }
+func (m *Label) String() string { return proto.CompactTextString(m) }
+func (*Label) ProtoMessage()    {}
+
+type Sample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *Sample) Reset()         { *m = Sample{} }
+func (m *Sample) String() string { return proto.CompactTextString(m) }
+func (*Sample) ProtoMessage()    {}
+
+// Values of MetricMetadata.Type
+const (
+	MetricMetadataUnknown        int32 = 0
+	MetricMetadataCounter        int32 = 1
+	MetricMetadataGauge          int32 = 2
+	MetricMetadataSummary        int32 = 3
+	MetricMetadataHistogram      int32 = 4
+	MetricMetadataGaugeHistogram int32 = 5
+	MetricMetadataInfo           int32 = 6
+	MetricMetadataStateset       int32 = 7
+)
+
+type MetricMetadata struct {
+	Type             int32  `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
+	MetricFamilyName string `protobuf:"bytes,2,opt,name=metric_family_name,json=metricFamilyName,proto3" json:"metric_family_name,omitempty"`
+	Help             string `protobuf:"bytes,4,opt,name=help,proto3" json:"help,omitempty"`
+	Unit             string `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+}
+
+func (m *MetricMetadata) Reset()         { *m = MetricMetadata{} }
+func (m *MetricMetadata) String() string { return proto.CompactTextString(m) }
+func (*MetricMetadata) ProtoMessage()    {}
+
+// staleNaN marks a series that has gone away
+const staleNaN = 0x7ff0000000000002
+
+// maxRemoteWriteSize limits the size of a decompressed request
+const maxRemoteWriteSize = 32 << 20
+
+// remoteWriteStaleness is how long a series is kept after its last sample,
+// the same as the lookback of Prometheus queries
+const remoteWriteStaleness = 5 * time.Minute
+
+// remoteSeries is the latest sample of a series, and when it arrived
+type remoteSeries struct {
+	ts       *TimeSeries
+	received time.Time
+}
+
+// remoteSeriesKey identifies a series by its labels, which Prometheus sends
+// sorted
+func remoteSeriesKey(labels []*Label) string {
+	var key bytes.Buffer
+	for _, l := range labels {
+		key.WriteString(l.Name)
+		key.WriteByte(0xff)
+		key.WriteString(l.Value)
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+// RemoteWriteHandler receives samples from Prometheus remote_write and sends
+// them as events. Prometheus spreads series across many concurrent
+// requests, so the latest sample of each series is kept until Run converts
+// all of them at once, every interval.
+type RemoteWriteHandler struct {
+	converter *Converter
+	sender    Sender
+
+	mtx sync.Mutex
+	// Metadata arrives in its own requests, so it's kept for later ones
+	types  map[string]int32
+	series map[string]*remoteSeries
+}
+
+func NewRemoteWriteHandler(converter *Converter, sender Sender) *RemoteWriteHandler {
+	return &RemoteWriteHandler{
+		converter: converter,
+		sender:    sender,
+		types:     map[string]int32{},
+		series:    map[string]*remoteSeries{},
+	}
+}
+
+func (rw *RemoteWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n, err := snappy.DecodedLen(compressed); err != nil || n > maxRemoteWriteSize {
+		http.Error(w, "Invalid or too large snappy body", http.StatusBadRequest)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &WriteRequest{}
+	if err := proto.Unmarshal(data, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	rw.mtx.Lock()
+	for _, md := range req.Metadata {
+		rw.types[md.MetricFamilyName] = md.Type
+	}
+	for _, ts := range req.Timeseries {
+		key := remoteSeriesKey(ts.Labels)
+		sample, ok := latestSample(ts)
+		if !ok {
+			if len(ts.Samples) > 0 {
+				// Marked as stale
+				delete(rw.series, key)
+			}
+			continue
+		}
+		if prev, ok := rw.series[key]; ok && prev.ts.Samples[0].Timestamp > sample.Timestamp {
+			continue
+		}
+		rw.series[key] = &remoteSeries{
+			ts:       &TimeSeries{Labels: ts.Labels, Samples: []*Sample{sample}},
+			received: now,
+		}
+	}
+	rw.mtx.Unlock()
+
+	logrus.WithField("series", len(req.Timeseries)).Debug("Received remote write")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// flush forgets series without a sample within remoteWriteStaleness, and
+// converts and sends the others
+func (rw *RemoteWriteHandler) flush(now time.Time) {
+	rw.mtx.Lock()
+	req := &WriteRequest{Timeseries: make([]*TimeSeries, 0, len(rw.series))}
+	for key, rs := range rw.series {
+		if now.Sub(rs.received) > remoteWriteStaleness {
+			delete(rw.series, key)
+			continue
+		}
+		req.Timeseries = append(req.Timeseries, rs.ts)
+	}
+	mfs := RemoteWriteFamilies(req, rw.types)
+	rw.mtx.Unlock()
+
+	metricGroups := rw.converter.Convert(mfs, now)
+	if len(metricGroups) > 0 {
+		rw.sender.Send(metricGroups)
+	}
+}
+
+// Run sends the series received so far every interval, until ctx is
+// cancelled. It then sends them once more after drained is closed, when
+// the requests in flight have been handled and no more will be accepted.
+func (rw *RemoteWriteHandler) Run(ctx context.Context, interval time.Duration, drained <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-drained
+			rw.flush(time.Now())
+			return
+		case now := <-ticker.C:
+			rw.flush(now)
+		}
+	}
+}
+
+// RemoteWriteFamilies turns the latest sample of each series in req into
+// metric families. Series are typed by types, the MetricMetadata.Type of
+// each family, and histograms and summaries are put back together from
+// their _bucket, _sum and _count series. Series without metadata are
+// untyped.
+func RemoteWriteFamilies(req *WriteRequest, types map[string]int32) []*dto.MetricFamily {
+	b := &remoteWriteBuilder{
+		types:    types,
+		families: map[string]*dto.MetricFamily{},
+		metrics:  map[string]*dto.Metric{},
+	}
+	for _, ts := range req.Timeseries {
+		b.addSeries(ts)
+	}
+
+	result := make([]*dto.MetricFamily, 0, len(b.families))
+	for _, name := range b.order {
+		mf := b.families[name]
+		for _, m := range mf.Metric {
+			if h := m.Histogram; h != nil {
+				sort.Slice(h.Bucket, func(i, j int) bool { return h.Bucket[i].GetUpperBound() < h.Bucket[j].GetUpperBound() })
+			}
+			if s := m.Summary; s != nil {
+				sort.Slice(s.Quantile, func(i, j int) bool { return s.Quantile[i].GetQuantile() < s.Quantile[j].GetQuantile() })
+			}
+		}
+		result = append(result, mf)
+	}
+	return result
+}
+
+type remoteWriteBuilder struct {
+	types    map[string]int32
+	families map[string]*dto.MetricFamily
+	order    []string
+	// Metrics of histograms and summaries by family and labels
+	metrics map[string]*dto.Metric
+	// The metric that gauges of fields worked out before conversion belong
+	// to, by family, e.g. x_total for x_total.delta
+	fieldOf map[string]string
+}
+
+// family returns the family called name, creating it if needed
+func (b *remoteWriteBuilder) family(name string, typ dto.MetricType) *dto.MetricFamily {
+	mf, ok := b.families[name]
+	if !ok {
+		mf = &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+		b.families[name] = mf
+		b.order = append(b.order, name)
+	}
+	return mf
+}
+
+// latestSample returns the latest sample of ts, or false if there's none or
+// it marks the series as stale
+func latestSample(ts *TimeSeries) (*Sample, bool) {
+	var latest *Sample
+	for _, s := range ts.Samples {
+		if latest == nil || s.Timestamp >= latest.Timestamp {
+			latest = s
+		}
+	}
+	if latest == nil || math.Float64bits(latest.Value) == staleNaN {
+		return nil, false
+	}
+	return latest, true
+}
+
+func (b *remoteWriteBuilder) addSeries(ts *TimeSeries) {
+	sample, ok := latestSample(ts)
+	if !ok {
+		return
+	}
+	var name, le, quantile string
+	labels := make([]*dto.LabelPair, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		switch l.Name {
+		case "__name__":
+			name = l.Value
+			continue
+		case "le":
+			le = l.Value
+		case "quantile":
+			quantile = l.Value
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+	}
+	if name == "" {
+		return
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	m := &dto.Metric{Label: labels, TimestampMs: proto.Int64(sample.Timestamp)}
+	value := sample.Value
+
+	typ, ok := b.types[name]
+	if !ok {
+		// OpenMetrics counters are described without their suffix
+		if base := strings.TrimSuffix(name, "_total"); base != name && b.types[base] == MetricMetadataCounter {
+			typ, ok = MetricMetadataCounter, true
+		}
+	}
+	if ok {
+		switch typ {
+		case MetricMetadataCounter:
+			m.Counter = &dto.Counter{Value: proto.Float64(value)}
+			b.addMetric(name, dto.MetricType_COUNTER, m)
+			return
+		case MetricMetadataGauge, MetricMetadataInfo, MetricMetadataStateset, MetricMetadataGaugeHistogram:
+			m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+			b.addMetric(name, dto.MetricType_GAUGE, m)
+			return
+		case MetricMetadataSummary:
+			if q, err := strconv.ParseFloat(quantile, 64); err == nil {
+				s := b.cumulative(name, m, "quantile", dto.MetricType_SUMMARY).Summary
+				s.Quantile = append(s.Quantile, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(value)})
+				return
+			}
+		}
+	}
+
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_created"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base == name {
+			continue
+		}
+		baseType := b.types[base]
+		switch {
+		case baseType != MetricMetadataCounter && baseType != MetricMetadataHistogram && baseType != MetricMetadataSummary:
+			// Not part of a cumulative metric
+		case suffix == "_created":
+			// Used to detect resets, like the _created series of OpenMetrics
+			m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+			b.addMetric(name, dto.MetricType_GAUGE, m)
+			return
+		case baseType == MetricMetadataCounter:
+			// Counters only have _total and _created
+		case suffix == "_bucket":
+			upperBound, err := strconv.ParseFloat(le, 64)
+			if baseType != MetricMetadataHistogram || err != nil {
+				break
+			}
+			h := b.cumulative(base, m, "le", dto.MetricType_HISTOGRAM).Histogram
+			h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(upperBound), CumulativeCount: proto.Uint64(uint64(value))})
+			return
+		case suffix == "_sum":
+			setSum(b.cumulative(base, m, "", b.familyType(base)), value)
+			return
+		case suffix == "_count":
+			setCount(b.cumulative(base, m, "", b.familyType(base)), uint64(value))
+			return
+		}
+	}
+
+	m.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+	b.addMetric(name, dto.MetricType_UNTYPED, m)
+}
+
+func (b *remoteWriteBuilder) addMetric(name string, typ dto.MetricType, m *dto.Metric) {
+	mf := b.family(name, typ)
+	mf.Metric = append(mf.Metric, m)
+}
+
+func (b *remoteWriteBuilder) familyType(name string) dto.MetricType {
+	if b.types[name] == MetricMetadataHistogram {
+		return dto.MetricType_HISTOGRAM
+	}
+	return dto.MetricType_SUMMARY
+}
+
+// cumulative returns the histogram or summary metric of family name with
+// the labels of m, minus the label telling its buckets or quantiles apart
+func (b *remoteWriteBuilder) cumulative(name string, m *dto.Metric, ignoreLabel string, typ dto.MetricType) *dto.Metric {
+	labels := make([]*dto.LabelPair, 0, len(m.Label))
+	for _, lp := range m.Label {
+		if lp.GetName() != ignoreLabel {
+			labels = append(labels, lp)
+		}
+	}
+	key := name + "\xff" + labelsKey(&dto.Metric{Label: labels})
+	cm, ok := b.metrics[key]
+	if !ok {
+		cm = &dto.Metric{Label: labels, TimestampMs: m.TimestampMs}
+		if typ == dto.MetricType_HISTOGRAM {
+			cm.Histogram = &dto.Histogram{}
+		} else {
+			cm.Summary = &dto.Summary{}
+		}
+		b.metrics[key] = cm
+		b.addMetric(name, typ, cm)
+	}
+	if m.GetTimestampMs() > cm.GetTimestampMs() {
+		cm.TimestampMs = m.TimestampMs
+	}
+	return cm
+}
+
+func setSum(m *dto.Metric, sum float64) {
+	if m.Histogram != nil {
+		m.Histogram.SampleSum = proto.Float64(sum)
+	} else {
+		m.Summary.SampleSum = proto.Float64(sum)
+	}
+}
+
+func setCount(m *dto.Metric, count uint64) {
+	if m.Histogram != nil {
+		m.Histogram.SampleCount = proto.Uint64(count)
+	} else {
+		m.Summary.SampleCount = proto.Uint64(count)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func series(value float64, timestamp int64, labels ...string) *TimeSeries {
+	ts := &TimeSeries{Samples: []*Sample{{Value: value, Timestamp: timestamp}}}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, &Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return ts
+}
+
+func encodeWriteRequest(t *testing.T, req *WriteRequest) []byte {
+	data, err := proto.Marshal(req)
+	assert.NoError(t, err)
+	return snappy.Encode(nil, data)
+}
+
+func TestRemoteWriteFamilies(t *testing.T) {
+	req := &WriteRequest{
+		Timeseries: []*TimeSeries{
+			series(3, 1000, "__name__", "http_requests_total", "code", "200"),
+			series(0.5, 1000, "__name__", "memory_ratio"),
+			series(2, 1000, "__name__", "latency_seconds_bucket", "le", "1"),
+			series(1, 1000, "__name__", "latency_seconds_bucket", "le", "0.1"),
+			series(2, 1000, "__name__", "latency_seconds_bucket", "le", "+Inf"),
+			series(1.5, 2000, "__name__", "latency_seconds_sum"),
+			series(2, 1000, "__name__", "latency_seconds_count"),
+			series(0.2, 1000, "__name__", "gc_seconds", "quantile", "0.9"),
+			series(10, 1000, "__name__", "gc_seconds_count"),
+			series(math.Float64frombits(staleNaN), 1000, "__name__", "gone"),
+			series(7, 1000, "__name__", "no_metadata"),
+		},
+		Metadata: []*MetricMetadata{
+			{Type: MetricMetadataCounter, MetricFamilyName: "http_requests"},
+			{Type: MetricMetadataGauge, MetricFamilyName: "memory_ratio"},
+			{Type: MetricMetadataHistogram, MetricFamilyName: "latency_seconds"},
+			{Type: MetricMetadataSummary, MetricFamilyName: "gc_seconds"},
+		},
+	}
+	// Later samples win
+	req.Timeseries[1].Samples = append(req.Timeseries[1].Samples, &Sample{Value: 0.25, Timestamp: 2000})
+
+	types := map[string]int32{}
+	for _, md := range req.Metadata {
+		types[md.MetricFamilyName] = md.Type
+	}
+	mfs := familiesByName(RemoteWriteFamilies(req, types))
+	assert.Len(t, mfs, 5)
+	assert.Equal(t, 3.0, mfs["http_requests_total"].Metric[0].GetCounter().GetValue())
+	assert.Equal(t, "code", mfs["http_requests_total"].Metric[0].Label[0].GetName())
+	assert.Equal(t, 0.25, mfs["memory_ratio"].Metric[0].GetGauge().GetValue())
+
+	h := mfs["latency_seconds"].Metric[0]
+	assert.Equal(t, int64(2000), h.GetTimestampMs())
+	assert.Empty(t, h.Label)
+	assert.Equal(t, uint64(2), h.GetHistogram().GetSampleCount())
+	assert.Equal(t, 1.5, h.GetHistogram().GetSampleSum())
+	assert.Len(t, h.GetHistogram().Bucket, 3)
+	assert.Equal(t, 0.1, h.GetHistogram().Bucket[0].GetUpperBound())
+	assert.True(t, math.IsInf(h.GetHistogram().Bucket[2].GetUpperBound(), 1))
+
+	s := mfs["gc_seconds"].Metric[0].GetSummary()
+	assert.Equal(t, uint64(10), s.GetSampleCount())
+	assert.Equal(t, 0.2, s.Quantile[0].GetValue())
+
+	assert.Equal(t, 7.0, mfs["no_metadata"].Metric[0].GetUntyped().GetValue())
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	sender := &recordingSender{}
+	handler := NewRemoteWriteHandler(NewConverter(ConverterOptions{}), sender)
+	auth := &ReceiverAuth{BearerToken: "secret"}
+	rh := newReceiverHandler(auth, 1, handler)
+	server := httptest.NewServer(rh)
+	defer server.Close()
+
+	body := encodeWriteRequest(t, &WriteRequest{
+		Timeseries: []*TimeSeries{
+			series(2, 1000, "__name__", "kube_deployment_spec_replicas", "namespace", "default", "deployment", "web"),
+		},
+	})
+	post := func(token string, body []byte) int {
+		req, _ := http.NewRequest("POST", server.URL+"/api/v1/write", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("", body))
+	assert.Equal(t, http.StatusUnauthorized, post("wrong", body))
+	assert.Empty(t, sender.metricGroups)
+
+	assert.Equal(t, http.StatusNoContent, post("secret", body))
+	// Sent at the end of the interval rather than as it arrives
+	assert.Empty(t, sender.metricGroups)
+	now := time.Now()
+	handler.flush(now)
+	if assert.Len(t, sender.metricGroups, 1) {
+		assert.Equal(t, "deployment", sender.metricGroups[0].MetricGroup)
+		assert.Equal(t, map[string]interface{}{"kube_deployment_spec_replicas": 2.0}, datapointValues(sender.metricGroups))
+	}
+
+	assert.Equal(t, http.StatusBadRequest, post("secret", []byte("not snappy")))
+
+	// Metadata from earlier requests types later ones, and series are
+	// kept across requests, which Prometheus shards them between
+	assert.Equal(t, http.StatusNoContent, post("secret", encodeWriteRequest(t, &WriteRequest{
+		Metadata: []*MetricMetadata{{Type: MetricMetadataCounter, MetricFamilyName: "kube_pod_container_status_restarts_total"}},
+	})))
+	for _, restarts := range []float64{1, 4} {
+		sender.metricGroups = nil
+		assert.Equal(t, http.StatusNoContent, post("secret", encodeWriteRequest(t, &WriteRequest{
+			Timeseries: []*TimeSeries{
+				series(restarts, int64(restarts)*1000, "__name__", "kube_pod_container_status_restarts_total", "namespace", "default", "pod", "web-1", "container", "app"),
+			},
+		})))
+		assert.Equal(t, http.StatusNoContent, post("secret", body))
+		now = now.Add(time.Minute)
+		handler.flush(now)
+	}
+	values := datapointValues(sender.metricGroups)
+	assert.Equal(t, 3.0, values["kube_pod_container_status_restarts_total.delta"])
+	assert.Equal(t, 2.0, values["kube_deployment_spec_replicas"])
+
+	// Series are forgotten once marked stale, or without new samples
+	sender.metricGroups = nil
+	assert.Equal(t, http.StatusNoContent, post("secret", encodeWriteRequest(t, &WriteRequest{
+		Timeseries: []*TimeSeries{
+			series(math.Float64frombits(staleNaN), 5000, "__name__", "kube_deployment_spec_replicas", "namespace", "default", "deployment", "web"),
+		},
+	})))
+	handler.flush(now)
+	assert.NotContains(t, datapointValues(sender.metricGroups), "kube_deployment_spec_replicas")
+	sender.metricGroups = nil
+	handler.flush(now.Add(remoteWriteStaleness + time.Minute))
+	assert.Empty(t, sender.metricGroups)
+
+	// Everything in flight, so callers have to come back later
+	rh.inflight <- struct{}{}
+	assert.Equal(t, http.StatusServiceUnavailable, post("secret", body))
+	<-rh.inflight
+	assert.Equal(t, http.StatusNoContent, post("secret", body))
+}
+
+func TestRemoteWriteHandlerRun(t *testing.T) {
+	sender := &recordingSender{}
+	handler := NewRemoteWriteHandler(NewConverter(ConverterOptions{}), sender)
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.Run(ctx, time.Hour, drained)
+	}()
+	cancel()
+
+	// Requests still in flight once ctx is cancelled are sent too
+	req := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(encodeWriteRequest(t, &WriteRequest{
+		Timeseries: []*TimeSeries{
+			series(2, 1000, "__name__", "kube_deployment_spec_replicas", "namespace", "default", "deployment", "web"),
+		},
+	})))
+	req.Header.Set("Content-Encoding", "snappy")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	close(drained)
+	<-done
+	assert.Equal(t, map[string]interface{}{"kube_deployment_spec_replicas": 2.0}, datapointValues(sender.metricGroups))
+}
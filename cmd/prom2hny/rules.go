@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// GroupRule puts every metric whose name matches Match into Group, with one
+// event per distinct value of the Keys labels. Group and Keys may refer to
+// submatches of Match, e.g. $1.
+type GroupRule struct {
+	Match string   `yaml:"match"`
+	Group string   `yaml:"group"`
+	Keys  []string `yaml:"keys"`
+
+	re *regexp.Regexp
+}
+
+// DefaultGroupRules group kube-state-metrics metrics, named
+// kube_<group>_*, by the object they describe. See
+// https://github.com/kubernetes/kube-state-metrics/tree/master/Documentation
+var DefaultGroupRules = []*GroupRule{
+	{Match: `kube_pod_container(_.*)?`, Group: "pod-container", Keys: []string{"namespace", "pod", "container"}},
+	{Match: `kube_pod_init_container(_.*)?`, Group: "pod-init-container", Keys: []string{"namespace", "pod", "container"}},
+	// Jobs are labeled job_name, since job is taken by Prometheus
+	{Match: `kube_job(_.*)?`, Group: "job", Keys: []string{"namespace", "job_name"}},
+	{Match: `kube_node(_.*)?`, Group: "node", Keys: []string{"node"}},
+	{Match: `kube_([^_]+)(_.*)?`, Group: "$1", Keys: []string{"namespace", "$1"}},
+}
+
+func init() {
+	for _, r := range DefaultGroupRules {
+		mustCompile(r)
+	}
+}
+
+// compiler is a rule that has to be compiled before it's used
+type compiler interface {
+	Compile() error
+}
+
+// mustCompile compiles one of the built-in rules, which are known to be
+// valid
+func mustCompile(r compiler) {
+	if err := r.Compile(); err != nil {
+		panic(err)
+	}
+}
+
+// compileMatch compiles the match pattern of a rule, which has to match the
+// whole metric name rather than part of it
+func compileMatch(match string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + match + ")$")
+}
+
+// Compile checks that the rule names a group and has a valid match
+func (r *GroupRule) Compile() error {
+	if r.Match == "" || r.Group == "" {
+		return errors.New("group rules need both match and group")
+	}
+	var err error
+	r.re, err = compileMatch(r.Match)
+	return err
+}
+
+// groupRuleMatch is the group and key labels of the rule matching a metric,
+// with its submatches filled in
+type groupRuleMatch struct {
+	group string
+	keys  []string
+}
+
+// matchGroupRule returns the group and key labels from the first rule
+// matching metricName
+func matchGroupRule(rules []*GroupRule, metricName string) (*groupRuleMatch, bool) {
+	for _, r := range rules {
+		submatches := r.re.FindStringSubmatchIndex(metricName)
+		if submatches == nil {
+			continue
+		}
+		expand := func(template string) string {
+			return string(r.re.ExpandString(nil, template, metricName, submatches))
+		}
+		match := &groupRuleMatch{group: expand(r.Group)}
+		for _, k := range r.Keys {
+			match.keys = append(match.keys, expand(k))
+		}
+		return match, true
+	}
+	return nil, false
+}
+
+// groupedKey identifies the event a series belongs to
+func (grm *groupRuleMatch) groupedKey(m *dto.Metric) string {
+	const SEP = ":"
+	labels := makeLabels(m)
+	values := make([]string, 0, len(grm.keys))
+	for _, k := range grm.keys {
+		values = append(values, labels[k])
+	}
+	return grm.group + SEP + strings.Join(values, SEP)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupRules(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prom2hny")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(filename, []byte(`
+group_rules:
+  - match: kube_(certificate)_(.*)
+    group: $1
+    keys: [namespace, name]
+  - match: redis_.*
+    group: redis
+    keys: [addr]
+`), 0644)
+	config, err := LoadConfig(filename)
+	assert.NoError(t, err)
+
+	const metrics = `kube_certificate_expiration_seconds{namespace="default",name="web",issuer="le"} 100
+kube_certificate_ready{namespace="default",name="web"} 1
+kube_node_spec_unschedulable{node="n1"} 0
+redis_connected_clients{addr="redis:6379"} 5
+unmatched_metric 1
+`
+	rules := append(config.GroupRules, DefaultGroupRules...)
+	groups := convertText(NewConverter(ConverterOptions{GroupRules: rules}), metrics, time.Now())
+	byName := map[string]*MetricGroup{}
+	for _, mg := range groups {
+		byName[mg.MetricGroup] = mg
+	}
+	assert.Len(t, byName, 3)
+	assert.Len(t, byName["certificate"].DataPoints, 2)
+	assert.Contains(t, byName, "node")
+	assert.Contains(t, byName, "redis")
+
+	// Without the defaults, kube_node_* is dropped
+	groups = convertText(NewConverter(ConverterOptions{GroupRules: config.GroupRules}), metrics, time.Now())
+	assert.Len(t, groups, 2)
+
+	ioutil.WriteFile(filename, []byte("group_rules: [{match: '(', group: x}]"), 0644)
+	_, err = LoadConfig(filename)
+	assert.Error(t, err)
+}
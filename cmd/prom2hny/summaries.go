@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+type summaryState struct {
+	count   uint64
+	sum     float64
+	created float64
+	time    time.Time
+}
+
+// getSummaryDatapoints returns each quantile as its own field, such as
+// <name>.p99, plus <name>.count and <name>.sum. With EmitSummaryDeltas,
+// <name>.count.delta and <name>.sum.delta cover the observations since the
+// last scrape.
+func (c *Converter) getSummaryDatapoints(mf *dto.MetricFamily, m *dto.Metric, createdTimes map[string]map[string]float64, now time.Time) []*DataPoint {
+	name := mf.GetName()
+	labels := makeLabels(m)
+	s := m.GetSummary()
+
+	dps := make([]*DataPoint, 0, len(s.Quantile)+4)
+	for _, q := range s.Quantile {
+		dps = append(dps, &DataPoint{Name: name + "." + quantileName(q.GetQuantile()), Value: q.GetValue(), Labels: labels})
+	}
+	dps = append(dps,
+		&DataPoint{Name: name + ".count", Value: s.GetSampleCount(), Labels: labels},
+		&DataPoint{Name: name + ".sum", Value: s.GetSampleSum(), Labels: labels},
+	)
+	if !c.options.EmitSummaryDeltas {
+		return dps
+	}
+
+	state := &summaryState{
+		count: s.GetSampleCount(),
+		sum:   s.GetSampleSum(),
+		time:  sampleTime(m, now),
+	}
+	created, hasCreated := createdTimes[createdName(name)][labelsKey(m)]
+	state.created = created
+
+	key := seriesKey(name, m)
+	prev, ok := c.prev[key].(*summaryState)
+	c.next[key] = state
+	if !ok || !state.time.After(prev.time) {
+		return dps
+	}
+
+	countDelta, sumDelta := state.count, state.sum
+	if state.count >= prev.count && !(hasCreated && created != prev.created) {
+		countDelta -= prev.count
+		sumDelta -= prev.sum
+	}
+	return append(dps,
+		&DataPoint{Name: name + ".count.delta", Value: countDelta, Labels: labels},
+		&DataPoint{Name: name + ".sum.delta", Value: sumDelta, Labels: labels},
+	)
+}
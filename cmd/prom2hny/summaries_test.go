@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummaryDatapoints(t *testing.T) {
+	const schedulingSeconds = `# TYPE kube_scheduler_e2e_scheduling_seconds summary
+kube_scheduler_e2e_scheduling_seconds{quantile="0.5"} 0.01
+kube_scheduler_e2e_scheduling_seconds{quantile="0.99"} 0.2
+kube_scheduler_e2e_scheduling_seconds{quantile="0.999"} 0.5
+kube_scheduler_e2e_scheduling_seconds_sum %s
+kube_scheduler_e2e_scheduling_seconds_count %s
+# TYPE kube_scheduler_pending_pods gauge
+kube_scheduler_pending_pods 4
+`
+	fill := func(sum, count string) string {
+		return strings.Replace(strings.Replace(schedulingSeconds, "%s", sum, 1), "%s", count, 1)
+	}
+
+	c := NewConverter(ConverterOptions{})
+	groups := convertText(c, fill("3", "100"), time.Now())
+	assert.Len(t, groups, 1)
+	assert.Equal(t, map[string]interface{}{
+		"kube_scheduler_e2e_scheduling_seconds.p50":   0.01,
+		"kube_scheduler_e2e_scheduling_seconds.p99":   0.2,
+		"kube_scheduler_e2e_scheduling_seconds.p999":  0.5,
+		"kube_scheduler_e2e_scheduling_seconds.sum":   3.0,
+		"kube_scheduler_e2e_scheduling_seconds.count": uint64(100),
+		"kube_scheduler_pending_pods":                 4.0,
+	}, datapointValues(groups))
+
+	c = NewConverter(ConverterOptions{EmitSummaryDeltas: true})
+	start := time.Now()
+	convertText(c, fill("3", "100"), start)
+	values := datapointValues(convertText(c, fill("4.5", "130"), start.Add(time.Minute)))
+	assert.Equal(t, uint64(30), values["kube_scheduler_e2e_scheduling_seconds.count.delta"])
+	assert.Equal(t, 1.5, values["kube_scheduler_e2e_scheduling_seconds.sum.delta"])
+
+	// Reset
+	values = datapointValues(convertText(c, fill("0.5", "10"), start.Add(2*time.Minute)))
+	assert.Equal(t, uint64(10), values["kube_scheduler_e2e_scheduling_seconds.count.delta"])
+}
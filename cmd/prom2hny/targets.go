@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Target is a single Prometheus endpoint to scrape. Labels are attached to
+// every event produced from the target. Config holds the credentials used to
+// scrape it; a nil Config scrapes without any.
+type Target struct {
+	URL    string
+	Labels map[string]string
+	Config *ScrapeConfig
+}
+
+// Key uniquely identifies a target by its job, URL and labels
+func (t *Target) Key() string {
+	names := make([]string, 0, len(t.Labels))
+	for name := range t.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := t.URL
+	if t.Config != nil && t.Config.JobName != "" {
+		key = t.Config.JobName + "/" + key
+	}
+	for _, name := range names {
+		key += "," + name + "=" + t.Labels[name]
+	}
+	return key
+}
+
+// eventLabels returns the labels added to each event scraped from the target
+func (t *Target) eventLabels() map[string]string {
+	labels := make(map[string]string, len(t.Labels)+1)
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+	labels["scrape_target"] = t.URL
+	return labels
+}
+
+// scrapePool runs one scrapeLoop per target, so a slow or failing target
+// doesn't hold up the others
+type scrapePool struct {
+	interval         time.Duration
+	sender           Sender
+	converterOptions ConverterOptions
+
+	mtx     sync.Mutex
+	loops   map[string]*scrapeLoop
+	stopped bool
+	// Running loops, including stopped ones still finishing a send
+	wg sync.WaitGroup
+}
+
+func newScrapePool(interval time.Duration, sender Sender, converterOptions ConverterOptions) *scrapePool {
+	return &scrapePool{
+		interval:         interval,
+		sender:           sender,
+		converterOptions: converterOptions,
+		loops:            make(map[string]*scrapeLoop),
+	}
+}
+
+// Sync starts scraping targets that aren't yet being scraped and stops
+// scraping the ones that are no longer present
+func (sp *scrapePool) Sync(targets []*Target) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	sp.sync(targets)
+}
+
+func (sp *scrapePool) sync(targets []*Target) {
+	if sp.stopped {
+		return
+	}
+
+	active := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		key := t.Key()
+		active[key] = true
+		if _, ok := sp.loops[key]; ok {
+			continue
+		}
+		options := sp.converterOptions
+		if t.Config != nil && t.Config.converterOptions != nil {
+			options = *t.Config.converterOptions
+		}
+		sl := newScrapeLoop(t, sp.interval, sp.sender, NewConverter(options))
+		sp.loops[key] = sl
+		sp.wg.Add(1)
+		go func() {
+			defer sp.wg.Done()
+			sl.run()
+		}()
+		logrus.WithField("target", t.URL).Info("Started scraping target")
+	}
+
+	for key, sl := range sp.loops {
+		if active[key] {
+			continue
+		}
+		sl.stop()
+		delete(sp.loops, key)
+		logrus.WithField("target", sl.target.URL).Info("Stopped scraping target")
+	}
+}
+
+// Stop stops all running scrape loops and waits for them to return, so
+// nothing is sent afterwards. Later calls to Sync have no effect.
+func (sp *scrapePool) Stop() {
+	sp.mtx.Lock()
+	sp.sync(nil)
+	sp.stopped = true
+	sp.mtx.Unlock()
+	sp.wg.Wait()
+}
+
+// scrapeLoop scrapes a target once per interval. Scrapes run one at a time
+// and are cut off at the end of the interval, so slow targets never pile up
+// overlapping scrapes.
+type scrapeLoop struct {
+	target    *Target
+	interval  time.Duration
+	sender    Sender
+	converter *Converter
+	// Last kube-state-metrics version detected, so changes are logged
+	kubeStateMetricsVersion string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newScrapeLoop(target *Target, interval time.Duration, sender Sender, converter *Converter) *scrapeLoop {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scrapeLoop{
+		target:    target,
+		interval:  interval,
+		sender:    sender,
+		converter: converter,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Spread targets across the interval instead of scraping them all at once.
+// The offset is derived from the target so it stays stable across restarts.
+func (sl *scrapeLoop) offset() time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(sl.target.Key()))
+	return time.Duration(h.Sum64() % uint64(sl.interval))
+}
+
+func (sl *scrapeLoop) run() {
+	select {
+	case <-time.After(sl.offset()):
+	case <-sl.ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(sl.interval)
+	defer ticker.Stop()
+	for {
+		sl.scrape()
+		select {
+		case <-ticker.C:
+		case <-sl.ctx.Done():
+			return
+		}
+	}
+}
+
+func (sl *scrapeLoop) scrape() {
+	config := sl.target.Config
+	if config == nil {
+		config = &ScrapeConfig{}
+	}
+	ctx, cancel := context.WithTimeout(sl.ctx, sl.interval)
+	defer cancel()
+	metricFamilies, err := config.Scrape(ctx, sl.target.URL)
+	if err != nil {
+		if sl.ctx.Err() != nil {
+			// Stopped mid-scrape
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"target": sl.target.URL,
+		}).Error("Error scraping metrics")
+		return
+	}
+
+	metricGroups := sl.converter.Convert(metricFamilies, time.Now())
+	if version := sl.converter.KubeStateMetricsVersion(); version != sl.kubeStateMetricsVersion {
+		sl.kubeStateMetricsVersion = version
+		logrus.WithFields(logrus.Fields{
+			"version": version,
+			"target":  sl.target.URL,
+		}).Info("Detected kube-state-metrics version")
+	}
+	labels := sl.target.eventLabels()
+	for _, mg := range metricGroups {
+		mg.Labels = labels
+	}
+	sl.sender.Send(metricGroups)
+}
+
+// stop cancels any in-flight scrape and ends the loop
+func (sl *scrapeLoop) stop() {
+	sl.cancel()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSender struct {
+	mtx          sync.Mutex
+	metricGroups []*MetricGroup
+}
+
+func (rs *recordingSender) Send(metricGroups []*MetricGroup) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	rs.metricGroups = append(rs.metricGroups, metricGroups...)
+}
+
+func (rs *recordingSender) targets() map[string]bool {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	result := map[string]bool{}
+	for _, mg := range rs.metricGroups {
+		result[mg.Labels["scrape_target"]] = true
+	}
+	return result
+}
+
+func TestScrapePoolSync(t *testing.T) {
+	metrics, _ := ioutil.ReadFile("./fixtures/metrics_1.0.txt")
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(metrics)
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer bad.Close()
+
+	sender := &recordingSender{}
+	pool := newScrapePool(10*time.Millisecond, sender, ConverterOptions{})
+	defer pool.Stop()
+
+	pool.Sync([]*Target{{URL: bad.URL}, {URL: good.URL}})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, map[string]bool{good.URL: true}, sender.targets())
+	assert.Len(t, pool.loops, 2)
+
+	pool.Sync([]*Target{{URL: good.URL}})
+	assert.Len(t, pool.loops, 1)
+	assert.Contains(t, pool.loops, (&Target{URL: good.URL}).Key())
+}
+
+func TestScrapePoolConverterOptions(t *testing.T) {
+	pool := newScrapePool(time.Hour, &recordingSender{}, ConverterOptions{Mode: ModeKubeStateMetrics})
+	defer pool.Stop()
+	generic := ConverterOptions{Mode: ModeGeneric}
+	ksm := &Target{URL: "http://ksm/metrics", Config: &ScrapeConfig{}}
+	query := &Target{URL: "http://prometheus/", Config: &ScrapeConfig{converterOptions: &generic}}
+	pool.Sync([]*Target{ksm, query})
+	assert.Equal(t, ModeKubeStateMetrics, pool.loops[ksm.Key()].converter.options.Mode)
+	assert.Equal(t, ModeGeneric, pool.loops[query.Key()].converter.options.Mode)
+}
+
+// blockingSender holds up Send until release is closed
+type blockingSender struct {
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingSender) Send(metricGroups []*MetricGroup) {
+	close(bs.sending)
+	<-bs.release
+}
+
+func TestScrapePoolStopWaits(t *testing.T) {
+	metrics, _ := ioutil.ReadFile("./fixtures/metrics_1.0.txt")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(metrics)
+	}))
+	defer server.Close()
+
+	sender := &blockingSender{sending: make(chan struct{}), release: make(chan struct{})}
+	pool := newScrapePool(time.Hour, sender, ConverterOptions{})
+	// Scrape straight away rather than after the target's offset
+	sl := newScrapeLoop(&Target{URL: server.URL}, time.Hour, sender, NewConverter(ConverterOptions{}))
+	pool.loops[(&Target{URL: server.URL}).Key()] = sl
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+		sl.scrape()
+	}()
+	<-sender.sending
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while a send was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(sender.release)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop didn't return after the send finished")
+	}
+}
+
+func TestTargetKey(t *testing.T) {
+	a := &Target{URL: "http://a/metrics", Labels: map[string]string{"x": "1", "y": "2"}}
+	b := &Target{URL: "http://a/metrics", Labels: map[string]string{"y": "2", "x": "1"}}
+	c := &Target{URL: "http://a/metrics"}
+	assert.Equal(t, a.Key(), b.Key())
+	assert.NotEqual(t, a.Key(), c.Key())
+	assert.Equal(t, "http://a/metrics,x=1,y=2", a.Key())
+}
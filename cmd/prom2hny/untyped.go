@@ -0,0 +1,65 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CompileMetricPatterns compiles regular expressions that must match whole
+// metric names
+func CompileMetricPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := compileMatch(p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// resolveUntyped replaces untyped families with gauges, or with counters if
+// they match one of the UntypedCounters patterns. Other families are
+// returned as-is.
+func (c *Converter) resolveUntyped(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	result := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_UNTYPED {
+			result = append(result, mf)
+			continue
+		}
+
+		typ := dto.MetricType_GAUGE
+		for _, re := range c.options.UntypedCounters {
+			if re.MatchString(mf.GetName()) {
+				typ = dto.MetricType_COUNTER
+				break
+			}
+		}
+
+		resolved := &dto.MetricFamily{
+			Name:   mf.Name,
+			Help:   mf.Help,
+			Type:   typ.Enum(),
+			Metric: make([]*dto.Metric, 0, len(mf.Metric)),
+		}
+		for _, m := range mf.Metric {
+			value := proto.Float64(m.GetUntyped().GetValue())
+			rm := &dto.Metric{
+				Label:       m.Label,
+				TimestampMs: m.TimestampMs,
+			}
+			if typ == dto.MetricType_COUNTER {
+				rm.Counter = &dto.Counter{Value: value}
+			} else {
+				rm.Gauge = &dto.Gauge{Value: value}
+			}
+			resolved.Metric = append(resolved.Metric, rm)
+		}
+		result = append(result, resolved)
+	}
+	return result
+}
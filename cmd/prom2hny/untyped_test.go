@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fillValues replaces each %s in text with the next value
+func fillValues(text string, values ...string) string {
+	for _, v := range values {
+		text = strings.Replace(text, "%s", v, 1)
+	}
+	return text
+}
+
+func TestUntypedMetrics(t *testing.T) {
+	const textfile = `kube_node_textfile_temperature_celsius{node="n1"} 41.5
+kube_node_textfile_reboots{node="n1"} %s
+`
+	patterns, err := CompileMetricPatterns([]string{"kube_node_textfile_reboots"})
+	assert.NoError(t, err)
+	c := NewConverter(ConverterOptions{UntypedCounters: patterns})
+	start := time.Now()
+
+	values := datapointValues(convertText(c, fillValues(textfile, "2"), start))
+	assert.Equal(t, map[string]interface{}{
+		"kube_node_textfile_temperature_celsius": 41.5,
+	}, values)
+
+	values = datapointValues(convertText(c, fillValues(textfile, "3"), start.Add(time.Second)))
+	assert.Equal(t, 41.5, values["kube_node_textfile_temperature_celsius"])
+	assert.Equal(t, 1.0, values["kube_node_textfile_reboots.delta"])
+
+	// Patterns match whole names
+	patterns, _ = CompileMetricPatterns([]string{"reboots"})
+	c = NewConverter(ConverterOptions{UntypedCounters: patterns})
+	values = datapointValues(convertText(c, fillValues(textfile, "3"), start))
+	assert.Equal(t, 3.0, values["kube_node_textfile_reboots"])
+
+	_, err = CompileMetricPatterns([]string{"("})
+	assert.Error(t, err)
+}
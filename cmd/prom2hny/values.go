@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// invalidNameChars are replaced when label values become part of a name,
+// e.g. nvidia.com/gpu
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+const (
+	// ValueRuleLabelsOnly metrics only contribute their labels to the event,
+	// e.g. kube_pod_info
+	ValueRuleLabelsOnly = "labels_only"
+	// ValueRuleLabelValue metrics have one series per possible value, and
+	// the one set to 1 says which, e.g. kube_pod_status_phase{phase="Running"}.
+	// The value of Label becomes the value of the metric.
+	ValueRuleLabelValue = "label_value"
+	// ValueRuleRenameByLabel is like ValueRuleLabelValue, but the metric is
+	// renamed after its other labels, so each gets its own field, e.g.
+	// kube_node_status_${condition}
+	ValueRuleRenameByLabel = "rename_by_label"
+	// ValueRuleRename metrics keep their value, but are renamed after their
+	// labels, which are then dropped, e.g. $0_${resource}_${unit} for
+	// kube_node_status_allocatable{resource="cpu",unit="core"}
+	ValueRuleRename = "rename"
+)
+
+// ValueRule changes how the value of every gauge whose name matches Match
+// is turned into a field. Name may refer to labels as $label or ${label},
+// and to submatches of Match as $1.
+type ValueRule struct {
+	Match string `yaml:"match"`
+	Type  string `yaml:"type"`
+	Label string `yaml:"label"`
+	Name  string `yaml:"name"`
+
+	re *regexp.Regexp
+}
+
+// Compile checks that the rule's type is known and has the label and name
+// it needs
+func (r *ValueRule) Compile() error {
+	if r.Match == "" {
+		return errors.New("value rules need a match")
+	}
+	switch r.Type {
+	case ValueRuleLabelsOnly:
+	case ValueRuleLabelValue:
+		if r.Label == "" {
+			return fmt.Errorf("%s rules need a label", r.Type)
+		}
+	case ValueRuleRenameByLabel:
+		if r.Label == "" || r.Name == "" {
+			return fmt.Errorf("%s rules need both label and name", r.Type)
+		}
+	case ValueRuleRename:
+		if r.Name == "" {
+			return fmt.Errorf("%s rules need a name", r.Type)
+		}
+	default:
+		return fmt.Errorf("unknown value rule type %q", r.Type)
+	}
+	var err error
+	r.re, err = compileMatch(r.Match)
+	return err
+}
+
+// valueRuleMatch is the rule matching a gauge, with the submatches its Name
+// may refer to
+type valueRuleMatch struct {
+	*ValueRule
+	submatches []string
+}
+
+// matchValueRule returns the first rule matching metricName
+func matchValueRule(rules []*ValueRule, metricName string) (*valueRuleMatch, bool) {
+	for _, r := range rules {
+		if submatches := r.re.FindStringSubmatch(metricName); submatches != nil {
+			return &valueRuleMatch{ValueRule: r, submatches: submatches}, true
+		}
+	}
+	return nil, false
+}
+
+// expandName fills in the submatches and labels Name refers to, and
+// returns the names of those labels
+func (vrm *valueRuleMatch) expandName(labels map[string]string) (string, []string) {
+	var used []string
+	name := os.Expand(vrm.Name, func(key string) string {
+		if i, err := strconv.Atoi(key); err == nil {
+			if i < len(vrm.submatches) {
+				return vrm.submatches[i]
+			}
+			return ""
+		}
+		used = append(used, key)
+		return invalidNameChars.ReplaceAllString(labels[key], "_")
+	})
+	return name, used
+}
+
+// getGaugeDatapoint turns a gauge series into a datapoint according to the
+// first value rule matching its name, or nil if the series doesn't
+// contribute to the event
+func getGaugeDatapoint(rules []*ValueRule, mf *dto.MetricFamily, m *dto.Metric) *DataPoint {
+	dp := &DataPoint{
+		Name:   mf.GetName(),
+		Labels: makeLabels(m),
+	}
+
+	rule, ok := matchValueRule(rules, dp.Name)
+	if !ok {
+		dp.Value = m.GetGauge().GetValue()
+		return dp
+	}
+
+	switch rule.Type {
+	case ValueRuleLabelsOnly:
+		// Only contribute labels
+	case ValueRuleLabelValue:
+		if m.GetGauge().GetValue() != 1 {
+			return nil
+		}
+		dp.Value = dp.Labels[rule.Label]
+		delete(dp.Labels, rule.Label)
+	case ValueRuleRenameByLabel:
+		if m.GetGauge().GetValue() != 1 {
+			return nil
+		}
+		dp.Name, _ = rule.expandName(dp.Labels)
+		dp.Value = dp.Labels[rule.Label]
+	case ValueRuleRename:
+		var used []string
+		dp.Name, used = rule.expandName(dp.Labels)
+		dp.Value = m.GetGauge().GetValue()
+		for _, l := range used {
+			delete(dp.Labels, l)
+		}
+	}
+	return dp
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultValueRules(t *testing.T) {
+	const metrics = `kube_pod_status_phase{namespace="default",pod="web",phase="Pending"} 0
+kube_pod_status_phase{namespace="default",pod="web",phase="Running"} 1
+kube_pod_info{namespace="default",pod="web",host_ip="10.0.0.1"} 1
+kube_node_status_condition{node="n1",condition="Ready",status="true"} 1
+kube_node_status_condition{node="n1",condition="Ready",status="false"} 0
+kube_node_spec_unschedulable{node="n1"} 0
+`
+	groups := convertText(NewConverter(ConverterOptions{}), metrics, time.Now())
+	assert.Equal(t, map[string]interface{}{
+		"kube_pod_status_phase":        "Running",
+		"kube_pod_info":                nil,
+		"kube_node_status_Ready":       "true",
+		"kube_node_spec_unschedulable": 0.0,
+		"kube_state_metrics_version":   KubeStateMetricsV1,
+	}, datapointValues(groups))
+
+	for _, mg := range groups {
+		if mg.MetricGroup != "pod" {
+			continue
+		}
+		for _, dp := range mg.DataPoints {
+			assert.NotContains(t, dp.Labels, "phase")
+		}
+	}
+}
+
+func TestValueRulesConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prom2hny")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(filename, []byte(`
+value_rules:
+  - match: kube_certificate_info
+    type: labels_only
+  - match: kube_certificate_status
+    type: label_value
+    label: state
+  - match: kube_certificate_condition
+    type: rename_by_label
+    label: status
+    name: kube_certificate_${condition}
+  - match: kube_certificate_(usages)
+    type: rename
+    name: kube_certificate_${1}_${usage}
+`), 0644)
+	config, err := LoadConfig(filename)
+	assert.NoError(t, err)
+
+	const metrics = `kube_certificate_info{namespace="default",certificate="web",issuer="le"} 1
+kube_certificate_status{namespace="default",certificate="web",state="issued"} 1
+kube_certificate_status{namespace="default",certificate="web",state="pending"} 0
+kube_certificate_condition{namespace="default",certificate="web",condition="Ready",status="True"} 1
+kube_certificate_expiry_seconds{namespace="default",certificate="web"} 100
+kube_certificate_usages{namespace="default",certificate="web",usage="server auth"} 1
+`
+	groups := convertText(NewConverter(ConverterOptions{ValueRules: config.ValueRules}), metrics, time.Now())
+	assert.Equal(t, map[string]interface{}{
+		"kube_certificate_info":               nil,
+		"kube_certificate_status":             "issued",
+		"kube_certificate_Ready":              "True",
+		"kube_certificate_expiry_seconds":     100.0,
+		"kube_certificate_usages_server_auth": 1.0,
+	}, datapointValues(groups))
+
+	for _, bad := range []string{
+		"value_rules: [{match: x, type: label_value}]",
+		"value_rules: [{match: x, type: rename_by_label, label: status}]",
+		"value_rules: [{match: x, type: rename}]",
+		"value_rules: [{match: x, type: other}]",
+		"value_rules: [{match: '(', type: labels_only}]",
+	} {
+		ioutil.WriteFile(filename, []byte(bad), 0644)
+		_, err = LoadConfig(filename)
+		assert.Error(t, err, bad)
+	}
+}